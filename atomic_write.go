@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const tempFilePattern = ".tmp-*"
+
+// writeFileAtomic replaces the file at path with what write produces. The content goes to a
+// temp file next to path which is synced and then renamed over path, so a crash leaves either
+// the old file or the new one, never a mix, and never no file. When backup is set, the file
+// being replaced is linked there first.
+func writeFileAtomic(path, backup string, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+tempFilePattern)
+	if err != nil {
+		return fmt.Errorf("problem creating temp file for %s, %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("problem writing %s, %v", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("problem syncing %s, %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("problem closing %s, %v", tmp.Name(), err)
+	}
+	if backup != "" {
+		if err := linkBackup(path, backup); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("problem replacing %s, %v", path, err)
+	}
+	return syncDir(dir)
+}
+
+// linkBackup makes backup another link to the file at path, if there is one. The link is made
+// under a temp name and renamed over backup, so path is never moved and backup is always whole.
+func linkBackup(path, backup string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(backup), filepath.Base(backup)+tempFilePattern)
+	if err != nil {
+		return fmt.Errorf("problem creating temp file for %s, %v", backup, err)
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+
+	if err := os.Link(path, tmp.Name()); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("problem backing up %s, %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), backup); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("problem backing up %s, %v", path, err)
+	}
+	return nil
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("problem opening directory %s, %v", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("problem syncing directory %s, %v", dir, err)
+	}
+	return nil
+}
+
+// removeTempFiles deletes temp files left next to path by writes that never got renamed.
+func removeTempFiles(path string) error {
+	leftovers, err := filepath.Glob(path + tempFilePattern)
+	if err != nil {
+		return err
+	}
+	for _, name := range leftovers {
+		if err := os.Remove(name); err != nil {
+			return fmt.Errorf("problem removing leftover temp file %s, %v", name, err)
+		}
+	}
+	return nil
+}
@@ -1,23 +1,217 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	slowConsumerReason    = "slow consumer"
+	missedHeartbeatReason = "missed heartbeat"
+	shutdownReason        = "server shutting down"
+)
+
+var (
+	SlowConsumerErr = errors.New("client is not reading fast enough and has been disconnected")
+	ClientClosedErr = errors.New("client has been disconnected")
+)
+
+// SocketConfig tunes how the server talks to websocket clients. Fields that are not positive
+// fall back to DefaultSocketConfig.
+type SocketConfig struct {
+	WriteWait     time.Duration // Longest a single write may take before the client is dropped.
+	SendQueueSize int           // Frames queued for a client before it is considered too slow.
+	PingInterval  time.Duration // How often clients are pinged; must be shorter than PongWait.
+	PongWait      time.Duration // Longest a client may stay silent, without a pong or message, before it is dropped.
+}
+
+var DefaultSocketConfig = SocketConfig{
+	WriteWait:     10 * time.Second,
+	SendQueueSize: 512,
+	PingInterval:  25 * time.Second,
+	PongWait:      60 * time.Second,
+}
+
+// withDefaults returns c with the fields that are not positive taken from DefaultSocketConfig, as
+// clients cannot be pinged every 0s nor queue no frames at all.
+func (c SocketConfig) withDefaults() SocketConfig {
+	if c.WriteWait <= 0 {
+		c.WriteWait = DefaultSocketConfig.WriteWait
+	}
+	if c.SendQueueSize <= 0 {
+		c.SendQueueSize = DefaultSocketConfig.SendQueueSize
+	}
+	if c.PingInterval <= 0 {
+		c.PingInterval = DefaultSocketConfig.PingInterval
+	}
+	if c.PongWait <= 0 {
+		c.PongWait = DefaultSocketConfig.PongWait
+	}
+	return c
+}
+
+// ClientWS is a websocket client. Frames sent to it are queued and written by its own writer
+// goroutine, so that a stalled client never holds up the others.
 type ClientWS struct {
 	socket *websocket.Conn
 	pair   bool
+	config SocketConfig
+
+	communities []string // The communities a chat client follows, or none to follow every community.
+
+	send      chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeMsg  []byte
+	flush     bool          // Write the queued frames before the close message.
+	done      chan struct{} // Closed when the writer has let go of the connection.
+	readOnce  sync.Once     // Starts the heartbeat deadline on the first read.
 }
 
-func (c ClientWS) SendThreads(t Threads) error {
-	err := c.socket.WriteJSON(t)
-	return err
+func newClientWS(conn *websocket.Conn, pair bool, config SocketConfig) *ClientWS {
+	config = config.withDefaults()
+	c := &ClientWS{
+		socket: conn,
+		pair:   pair,
+		config: config,
+		send:   make(chan []byte, config.SendQueueSize),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+
+	go c.writePump()
+	return c
+}
+
+// extendReadDeadline gives the client another PongWait to show it is still there.
+func (c *ClientWS) extendReadDeadline() {
+	c.socket.SetReadDeadline(time.Now().Add(c.config.PongWait))
+}
+
+// Send queues msg for the client. A client whose queue is full, or that takes longer than
+// WriteWait to accept a write, is disconnected as a slow consumer rather than blocking the sender.
+func (c *ClientWS) Send(msg []byte) error {
+	select {
+	case <-c.closed:
+		return ClientClosedErr
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+		return nil
+	default:
+		c.evict()
+		return SlowConsumerErr
+	}
+}
 
+// SendFrames encodes every frame as JSON and queues it for the client.
+func (c *ClientWS) SendFrames(frames []interface{}) error {
+	for _, frame := range frames {
+		msg, err := encodeFrame(frame)
+		if err != nil {
+			return err
+		}
+		if err := c.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close disconnects the client with a close code and reason once its writer is free.
+// Frames still queued are dropped.
+func (c *ClientWS) Close(code int, reason string) {
+	c.close(code, reason, false)
+}
+
+// CloseAfterFlush disconnects the client like Close, but only after writing the frames
+// already queued for it.
+func (c *ClientWS) CloseAfterFlush(code int, reason string) {
+	c.close(code, reason, true)
+}
+
+// close reports whether this call closed the client, rather than an earlier one.
+func (c *ClientWS) close(code int, reason string, flush bool) (closed bool) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		c.flush = flush
+		close(c.closed)
+		closed = true
+	})
+	return closed
+}
+
+// evict closes the client as a slow consumer, counting it once however it was found out.
+func (c *ClientWS) evict() {
+	if c.close(websocket.CloseTryAgainLater, slowConsumerReason, false) {
+		slowConsumerEvictions.Add(1)
+	}
+}
+
+// Done is closed once the client's connection has been closed.
+func (c *ClientWS) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *ClientWS) writePump() {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+	defer close(c.done)
+	defer c.socket.Close()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := c.socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.config.WriteWait))
+			if err != nil {
+				log.Printf("Error encountered when pinging client. %v", err)
+				c.Close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case msg := <-c.send:
+			if err := c.write(msg); err != nil {
+				return
+			}
+		case <-c.closed:
+			for c.flush && len(c.send) > 0 {
+				if err := c.write(<-c.send); err != nil {
+					return
+				}
+			}
+			c.socket.WriteControl(websocket.CloseMessage, c.closeMsg, time.Now().Add(c.config.WriteWait))
+			return
+		}
+	}
+}
+
+func (c *ClientWS) write(msg []byte) error {
+	c.socket.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
+	err := c.socket.WriteMessage(websocket.TextMessage, msg)
+	if err != nil {
+		log.Printf("Error encountered when sending to client. %v", err)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			c.evict()
+		}
+		c.Close(websocket.CloseAbnormalClosure, "")
+	}
+	return err
 }
 
-func (c ClientWS) GetThread() (Thread, error) {
+func (c *ClientWS) GetThread() (Thread, error) {
 	var t Thread
 	err := c.socket.ReadJSON(&t)
 	if err != nil {
@@ -28,78 +222,212 @@ func (c ClientWS) GetThread() (Thread, error) {
 	return t, nil
 }
 
-func (c ClientWS) WriteMessage(msg []byte) error {
-	err := c.socket.WriteMessage(websocket.TextMessage, msg)
-	return err
+// ReadFrame waits for the next message from the client; every message, like every pong,
+// extends the read deadline. A client that misses its heartbeats fails with a timeout.
+func (c *ClientWS) ReadFrame() ([]byte, error) {
+	c.readOnce.Do(c.extendReadDeadline)
+	_, frame, err := c.socket.ReadMessage()
+	if err == nil {
+		c.extendReadDeadline()
+	}
+	return frame, err
+}
+
+// CloseReason describes why reading from a client failed, for logging.
+func CloseReason(err error) string {
+	if ce, ok := err.(*websocket.CloseError); ok {
+		return fmt.Sprintf("closed by client (%d %s)", ce.Code, ce.Text)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return missedHeartbeatReason
+	}
+	return err.Error()
 }
 
+// encodeFrame returns raw messages as they are, and anything else encoded as JSON.
+func encodeFrame(payload interface{}) ([]byte, error) {
+	if msg, ok := payload.([]byte); ok {
+		return msg, nil
+	}
+	return json.Marshal(payload)
+}
+
+const (
+	ChatTopic = "chat"
+	PairTopic = "pair"
+)
+
 type WebSocketManager interface {
 	RemoveClient(client *ClientWS)
 	AddClient(client *ClientWS)
+	Subscribe(client *ClientWS, topic string)
+	Unsubscribe(client *ClientWS, topic string)
 	Broadcast([]*ClientWS, interface{})
+	GetSubscribers(topic string) []*ClientWS
 	GetPairClients() []*ClientWS
 	GetChatClients() []*ClientWS
 }
 
+// ClientManager is a hub owning the registry of connected clients. The registry is only ever
+// touched by the hub goroutine, and every other goroutine talks to it over channels.
 type ClientManager struct {
-	Clients map[*ClientWS]bool
+	register    chan *ClientWS
+	unregister  chan *ClientWS
+	subscribe   chan subscription
+	broadcast   chan broadcast
+	subscribers chan subscribersQuery
 }
 
-func (c ClientManager) AddClient(client *ClientWS) {
-	c.Clients[client] = true
-	log.Printf("Added client %v.", client)
+type subscription struct {
+	client    *ClientWS
+	topic     string
+	subscribe bool
+}
 
+type broadcast struct {
+	clients []*ClientWS
+	msg     []byte
 }
 
-func (c ClientManager) RemoveClient(client *ClientWS) {
-	delete(c.Clients, client)
-	log.Printf("Removed client %v.", client)
+// subscribersQuery asks for the clients subscribed to topic, or every client when topic is empty.
+type subscribersQuery struct {
+	topic string
+	reply chan []*ClientWS
 }
 
-func (c ClientManager) Broadcast(clients []*ClientWS, payload interface{}) {
-	switch payload.(type) {
-	case Threads:
-		for _, client := range clients {
-			threads := payload.(Threads)
-			err := client.SendThreads(threads)
-			if err != nil {
-				log.Printf("Error encountered when sending to client. %v", err) // TODO: Add missing client handling here.
-			}
+func NewClientManager() *ClientManager {
+	c := &ClientManager{
+		register:    make(chan *ClientWS),
+		unregister:  make(chan *ClientWS),
+		subscribe:   make(chan subscription),
+		broadcast:   make(chan broadcast),
+		subscribers: make(chan subscribersQuery),
+	}
+	go c.run()
+	return c
+}
+
+func (c *ClientManager) run() {
+	clients := make(map[*ClientWS]map[string]bool)
+	topics := make(map[string]map[*ClientWS]bool)
+
+	join := func(client *ClientWS, topic string) {
+		if topics[topic] == nil {
+			topics[topic] = make(map[*ClientWS]bool)
+		}
+		topics[topic][client] = true
+		clients[client][topic] = true
+	}
+	leave := func(client *ClientWS, topic string) {
+		delete(topics[topic], client)
+		if len(topics[topic]) == 0 {
+			delete(topics, topic)
 		}
+		delete(clients[client], topic)
+	}
 
-	case []byte:
-		for _, client := range clients {
-			msg := payload.([]byte)
-			err := client.WriteMessage(msg)
-			if err != nil {
-				log.Printf("Error encountered when sending to client. %v", err)
+	for {
+		select {
+		case client := <-c.register:
+			if clients[client] != nil {
+				continue
+			}
+			clients[client] = make(map[string]bool)
+			if client.pair {
+				join(client, PairTopic)
+			} else {
+				join(client, ChatTopic)
+				join(client, FeedTopic(client.communities))
 			}
+			log.Printf("Added client %p.", client)
+
+		case client := <-c.unregister:
+			if clients[client] == nil {
+				continue
+			}
+			for topic := range clients[client] {
+				leave(client, topic)
+			}
+			delete(clients, client)
+			log.Printf("Removed client %p.", client)
+
+		case sub := <-c.subscribe:
+			if clients[sub.client] == nil {
+				continue
+			}
+			if sub.subscribe {
+				join(sub.client, sub.topic)
+			} else {
+				leave(sub.client, sub.topic)
+			}
+
+		case b := <-c.broadcast:
+			for _, client := range b.clients {
+				if clients[client] == nil {
+					continue
+				}
+				err := client.Send(b.msg)
+				if err != nil {
+					log.Printf("Error encountered when sending to client. %v", err)
+				}
+			}
+
+		case q := <-c.subscribers:
+			var found []*ClientWS
+			if q.topic == "" {
+				for client := range clients {
+					found = append(found, client)
+				}
+			} else {
+				for client := range topics[q.topic] {
+					found = append(found, client)
+				}
+			}
+			q.reply <- found
 		}
 	}
 }
 
-func (c ClientManager) GetPairClients() []*ClientWS {
-	var clients []*ClientWS
-	for client := range c.Clients {
-		if !client.pair {
-			continue
-		}
-		clients = append(clients, client)
-	}
-	return clients
+func (c *ClientManager) AddClient(client *ClientWS) {
+	c.register <- client
 }
 
-func (c ClientManager) GetChatClients() []*ClientWS { // FIXME: Need to change naming!!
-	var clients []*ClientWS
-	for client := range c.Clients {
-		if client.pair {
-			continue
-		}
-		clients = append(clients, client)
+func (c *ClientManager) RemoveClient(client *ClientWS) {
+	c.unregister <- client
+}
+
+func (c *ClientManager) Subscribe(client *ClientWS, topic string) {
+	c.subscribe <- subscription{client: client, topic: topic, subscribe: true}
+}
+
+func (c *ClientManager) Unsubscribe(client *ClientWS, topic string) {
+	c.subscribe <- subscription{client: client, topic: topic}
+}
+
+// Broadcast encodes payload once and queues it for every client that is still registered.
+func (c *ClientManager) Broadcast(clients []*ClientWS, payload interface{}) {
+	msg, err := encodeFrame(payload)
+	if err != nil {
+		log.Printf("Unable to encode broadcast payload. %v", err)
+		return
 	}
-	return clients
+	c.broadcast <- broadcast{clients: clients, msg: msg}
 }
 
-func NewClientManager() *ClientManager {
-	return &ClientManager{Clients: make(map[*ClientWS]bool)}
+func (c *ClientManager) GetSubscribers(topic string) []*ClientWS {
+	reply := make(chan []*ClientWS)
+	c.subscribers <- subscribersQuery{topic: topic, reply: reply}
+	return <-reply
+}
+
+func (c *ClientManager) GetClients() []*ClientWS {
+	return c.GetSubscribers("")
+}
+
+func (c *ClientManager) GetPairClients() []*ClientWS {
+	return c.GetSubscribers(PairTopic)
+}
+
+func (c *ClientManager) GetChatClients() []*ClientWS { // FIXME: Need to change naming!!
+	return c.GetSubscribers(ChatTopic)
 }
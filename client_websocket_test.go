@@ -0,0 +1,79 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"server"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientManagerConcurrency(t *testing.T) {
+	const clientCount = 300
+
+	testWSManager := NewSpyClientManager()
+	threadServer := server.NewServer(server.AdaptThreadStore(&spyStore{}), testWSManager)
+	go threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws"
+
+	var wg sync.WaitGroup
+	for i := 0; i < clientCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			ws, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": []string{"http://localhost:3000"}})
+			if err != nil {
+				t.Errorf("could not open a ws connection on %s %v", wsURL, err)
+				return
+			}
+			defer ws.Close()
+
+			var snapshot server.Event
+			ws.SetReadDeadline(time.Now().Add(time.Second))
+			if err := ws.ReadJSON(&snapshot); err != nil || snapshot.Type != server.SnapshotEvent {
+				t.Errorf("wanted a snapshot on connect, got %v %v", snapshot.Type, err)
+			}
+
+			if i%10 == 0 {
+				response := httptest.NewRecorder()
+				threadServer.ServeHTTP(response, newPOSTRequest("/thread", newThreadPayload("Join the party", "Mouse")))
+				assertStatus(t, response, http.StatusOK)
+			}
+			testWSManager.GetChatClients()
+		}(i)
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < clientCount; i++ {
+			testWSManager.Broadcast(testWSManager.GetChatClients(), []byte("ping"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < clientCount; i++ {
+			for _, client := range testWSManager.GetClients() {
+				testWSManager.Subscribe(client, "party")
+				testWSManager.Unsubscribe(client, "party")
+			}
+		}
+	}()
+	wg.Wait()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(testWSManager.GetClients()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(testWSManager.GetClients()) != 0 {
+		t.Errorf("WS manager should have 0 sockets after every client left, but got %d", len(testWSManager.GetClients()))
+	}
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"server"
+	"syscall"
+	"time"
 )
 
-const dbFileName = "threads.db.json"
+const (
+	dbFileName  = "threads.db.json"
+	pairDirName = "pairs"
+	// defaultAdminAddr only listens on the loopback interface, as metrics are not for the public.
+	defaultAdminAddr = "localhost:6060"
+	shutdownTimeout  = 15 * time.Second
+)
 
 func main() {
 
@@ -15,17 +26,66 @@ func main() {
 	if port == "" {
 		port = "5000"
 	}
-	store, closeDB, err := server.NewFFSFromPath(dbFileName)
+	adminAddr := os.Getenv("ADMIN_ADDR")
+	if adminAddr == "" {
+		adminAddr = defaultAdminAddr
+	}
+	store, closeDB, err := openStore(os.Getenv("STORE"))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer closeDB()
+	pairStore, err := server.NewFilePairStore(pairDirName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	webserver := server.NewServer(store, server.NewClientManager())
-	go webserver.StartWorkers()
-	go webserver.StartWorkers()
+	webserver.PairStore = pairStore
+	webserver.StartWorkers()
+
+	httpServer := &http.Server{Addr: ":" + port, Handler: webserver}
+	go func() {
+		log.Printf("Starting server at http://localhost:%s\n", port)
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	admin := http.NewServeMux()
+	admin.Handle("/debug/vars", expvar.Handler())
+	adminServer := &http.Server{Addr: adminAddr, Handler: admin}
+	go func() {
+		log.Printf("Serving metrics at http://%s/debug/vars\n", adminAddr)
+		if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("Metrics listener stopped, %v", err)
+		}
+	}()
 
-	handler := http.HandlerFunc(webserver.ServeHTTP)
-	log.Printf("Starting server at http://localhost:%s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, handler))
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down, press Ctrl+C again to force.")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server did not shut down cleanly, %v", err)
+	}
+	adminServer.Shutdown(shutdownCtx)
+	if err := webserver.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Websocket clients did not shut down cleanly, %v", err)
+	}
+}
+
+// openStore opens the flat-file database, or the write-ahead log store when kind is "wal".
+// Both keep their threads in dbFileName, so switching to the log store migrates the data.
+func openStore(kind string) (server.ThreadStoreV2, func(), error) {
+	if kind == "wal" {
+		return server.NewWALStoreFromPath(dbFileName, server.DefaultWALCompactionThreshold)
+	}
+	return server.NewFFSFromPath(dbFileName)
 }
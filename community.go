@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// EveryCommunityTopic is joined by chat clients that did not pick communities to follow.
+	// They receive changes to every thread, whether it belongs to a community or not.
+	EveryCommunityTopic = "communities"
+
+	communityTopicPrefix = "c/"
+)
+
+// CommunityTopic is the topic joined by the chat clients following community alone.
+func CommunityTopic(community string) string {
+	return communityTopicPrefix + community
+}
+
+// FeedTopic is the topic joined by the chat clients following communities, which are sorted
+// without repeats, or every community when there are none. Each client joins a single topic,
+// so that it receives the events of a single feed.
+func FeedTopic(communities []string) string {
+	if len(communities) == 0 {
+		return EveryCommunityTopic
+	}
+	return communityTopicPrefix + strings.Join(communities, ",")
+}
+
+// getCommunitiesFromRequest reads the communities a chat client asks to follow with
+// ?community={name}, which may be repeated, sorted without repeats. None means every community.
+func getCommunitiesFromRequest(r *http.Request) ([]string, error) {
+	communities := r.URL.Query()["community"]
+	for _, community := range communities {
+		if !validName(community) {
+			return nil, InvalidCommunityErr
+		}
+	}
+	sort.Strings(communities)
+	unique := communities[:0]
+	for _, community := range communities {
+		if len(unique) == 0 || community != unique[len(unique)-1] {
+			unique = append(unique, community)
+		}
+	}
+	return unique, nil
+}
+
+// getCommunityPathFromRequest reads the community of /c/{community}/thread.
+func getCommunityPathFromRequest(r *http.Request) (community string, ok bool, err error) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "c" || parts[2] != "thread" {
+		return "", false, nil
+	}
+	if !validName(parts[1]) {
+		return "", true, InvalidCommunityErr
+	}
+	return parts[1], true, nil
+}
+
+// follows reports whether the client receives changes to threads in community.
+func (c *ClientWS) follows(community string) bool {
+	return follows(c.communities, community)
+}
+
+// follows reports whether following communities, or every community when there are none,
+// means following community.
+func follows(communities []string, community string) bool {
+	if len(communities) == 0 {
+		return true
+	}
+	for _, followed := range communities {
+		if followed == community {
+			return true
+		}
+	}
+	return false
+}
+
+// communityIndex lists, for each community, the positions of its threads in a store, in the
+// order they were saved. Threads keep their position once saved, deleted ones included.
+type communityIndex map[string][]int
+
+func indexCommunities(ts Threads) communityIndex {
+	index := make(communityIndex)
+	for i, t := range ts {
+		index.add(t, i)
+	}
+	return index
+}
+
+func (index communityIndex) add(t Thread, position int) {
+	if t.Community != "" {
+		index[t.Community] = append(index[t.Community], position)
+	}
+}
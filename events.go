@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+const (
+	SnapshotEvent       = "snapshot"
+	ThreadCreatedEvent  = "thread_created"
+	ThreadUpdatedEvent  = "thread_updated"
+	ThreadDeletedEvent  = "thread_deleted"
+	CommentCreatedEvent = "comment_created"
+	WeightsUpdatedEvent = "weights_updated"
+
+	// DefaultEventLogSize is how many recent events each feed keeps to replay to reconnecting
+	// clients.
+	DefaultEventLogSize = 256
+
+	// maxFeeds is how many feeds are kept before the ones no client follows are dropped.
+	maxFeeds = 64
+)
+
+// Event is pushed to chat clients to describe a single change.
+// Every event carries the sequence number of the change it describes; a snapshot carries the
+// sequence number of the last change it includes. Clients ignore events with a Seq at or below
+// the last one they applied, and ask for a new snapshot when they notice a gap. Events are
+// numbered within the feed of the communities a client follows, see feed. WeightsUpdatedEvent is
+// the exception: it is not a change, so it carries the Seq of the last one and is not replayed.
+type Event struct {
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq"`
+	Threads WeightedThreads `json:"threads,omitempty"`
+	Thread  *WeightedThread `json:"thread,omitempty"`
+	Comment *Comment        `json:"comment,omitempty"`
+	Weights map[int]float64 `json:"weights,omitempty"` // Thread ID to bubble weight.
+
+	community string // The community of the thread, or of the comment's thread.
+}
+
+// delivery is a batch of frames for the socketUpdater worker to send, either to a single client
+// (such as a reply, a requested snapshot or a replay) or, when client is nil, to the subscribers
+// of topics, or every chat client when there are none.
+type delivery struct {
+	client *ClientWS
+	topics []string
+	frames []interface{}
+}
+
+func eventFrames(events []Event) []interface{} {
+	frames := make([]interface{}, len(events))
+	for i, e := range events {
+		frames[i] = e
+	}
+	return frames
+}
+
+// feed numbers the events sent to the chat clients following one set of communities, so that
+// they see a sequence without gaps made only of the changes they follow. Its clients subscribe
+// to topic. A feed starts numbering from the number of changes published so far, which is at
+// least any number one of its earlier incarnations reached, so that a client coming back to a
+// dropped feed is sent a snapshot rather than a wrong replay.
+type feed struct {
+	topic       string
+	communities []string // Sorted, or none for every community.
+	seq         uint64
+	events      *eventLog
+}
+
+func (f *feed) follows(community string) bool {
+	return follows(f.communities, community)
+}
+
+// feedOf must be called with eventsMu held. It returns the feed of the communities client
+// follows, starting it when there is none yet.
+func (s *Server) feedOf(client *ClientWS) *feed {
+	topic := FeedTopic(client.communities)
+	if f, ok := s.feeds[topic]; ok {
+		return f
+	}
+	if len(s.feeds) >= maxFeeds {
+		s.dropIdleFeeds()
+	}
+	f := &feed{topic: topic, communities: client.communities, seq: s.seq, events: newEventLog(DefaultEventLogSize)}
+	s.feeds[topic] = f
+	return f
+}
+
+// dropIdleFeeds must be called with eventsMu held. It drops the feeds no client follows.
+func (s *Server) dropIdleFeeds() {
+	for topic := range s.feeds {
+		if len(s.socketManager.GetSubscribers(topic)) == 0 {
+			delete(s.feeds, topic)
+		}
+	}
+}
+
+// number must be called with eventsMu held. It gives e the next sequence number of f, keeps it
+// to replay and queues it for the clients of f.
+func (s *Server) number(f *feed, e Event) {
+	f.seq++
+	e.Seq = f.seq
+	f.events.append(e)
+	s.deliver(delivery{topics: []string{f.topic}, frames: []interface{}{e}})
+}
+
+// eventLog keeps the most recent events so that reconnecting clients can catch up.
+type eventLog struct {
+	events []Event
+	size   int
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{size: size}
+}
+
+func (l *eventLog) append(e Event) {
+	l.events = append(l.events, e)
+	if len(l.events) > l.size {
+		l.events = l.events[len(l.events)-l.size:]
+	}
+}
+
+// since returns the events after seq, up to current. It returns false when seq is unknown or
+// some of those events have already been dropped from the log.
+func (l *eventLog) since(seq, current uint64) ([]Event, bool) {
+	if seq > current {
+		return nil, false
+	}
+	if seq == current {
+		return nil, true
+	}
+	if len(l.events) == 0 || l.events[0].Seq > seq+1 {
+		return nil, false
+	}
+
+	first := seq + 1 - l.events[0].Seq
+	return append([]Event(nil), l.events[first:]...), true
+}
+
+// initialSeq starts sequence numbers from the boot time in microseconds, so sequence numbers held by
+// clients of a previous run are never mistaken for ones of this run. It stays well within the
+// integers JavaScript clients can represent exactly.
+func initialSeq() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+func threadEvent(eventType string, t Thread) Event {
+	return Event{Type: eventType, Thread: &WeightedThread{Thread: t, Weight: BubbleWeight(t, time.Now())}, community: t.Community}
+}
+
+// publish runs change and, when it succeeds, updates the search index and queues the event it
+// returns for the clients of every feed following its community, numbered within each feed.
+// Changes are serialised with snapshots so that a snapshot's Seq always matches the changes it
+// reflects.
+func (s *Server) publish(change func() (Event, error)) error {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+
+	if s.eventsClosed {
+		return ServerClosedErr
+	}
+	e, err := change()
+	if err != nil {
+		return err
+	}
+
+	if e.Thread != nil {
+		s.index.put(e.Thread.Thread)
+		if e.Thread.Deleted {
+			delete(s.weights, e.Thread.ID)
+		} else {
+			s.weights[e.Thread.ID] = e.Thread.Weight
+		}
+	}
+
+	s.seq++
+	for _, f := range s.feeds {
+		if f.follows(e.community) {
+			s.number(f, e)
+		}
+	}
+	return nil
+}
+
+// deliver must be called with eventsMu held. Deliveries made once the server has shut down
+// are dropped.
+func (s *Server) deliver(d delivery) {
+	if s.eventsClosed {
+		return
+	}
+	s.eventChannel <- d
+}
+
+// subscribe registers client for chat events and sends it what it needs to catch up: the events
+// after since when resume is set and they are still in the log, or a snapshot of every thread
+// it follows.
+func (s *Server) subscribe(client *ClientWS, since uint64, resume bool) error {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+
+	events, err := s.catchUp(client, since, resume)
+	if err != nil {
+		return err
+	}
+	if err := client.SendFrames(eventFrames(events)); err != nil {
+		return err
+	}
+	s.socketManager.AddClient(client)
+	return nil
+}
+
+// resend queues the events client needs to catch up, in order with the events that follow them.
+func (s *Server) resend(client *ClientWS, since uint64, resume bool) error {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+
+	events, err := s.catchUp(client, since, resume)
+	if err != nil {
+		return err
+	}
+	s.deliver(delivery{client: client, frames: eventFrames(events)})
+	return nil
+}
+
+// catchUp must be called with eventsMu held. It replays the events of client's feed after
+// since. Replays that would fill more than half of a client's send queue are replaced by a
+// snapshot, so catching up never evicts the client.
+func (s *Server) catchUp(client *ClientWS, since uint64, resume bool) ([]Event, error) {
+	f := s.feedOf(client)
+	if resume {
+		events, ok := f.events.since(since, f.seq)
+		if ok && len(events) <= client.config.SendQueueSize/2 {
+			return events, nil
+		}
+	}
+
+	threads, err := s.rankedThreads(context.Background(), client)
+	if err != nil {
+		return nil, err
+	}
+	return []Event{{Type: SnapshotEvent, Seq: f.seq, Threads: threads}}, nil
+}
+
+// RefreshWeights sends the clients of every feed the bubble weights of the threads it follows
+// that moved by weightStep or more since they were last sent, as of now. Weights are sent as
+// they are, rather than numbered and kept to replay like changes.
+func (s *Server) RefreshWeights(now time.Time) error {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+
+	if s.eventsClosed {
+		return ServerClosedErr
+	}
+	threads, err := s.store.GetThreads(context.Background())
+	if err != nil {
+		return storeFailure(err)
+	}
+
+	// Only the weights of live threads are kept, and those that barely moved keep the weight
+	// last sent, so that a slow drift is sent once it adds up.
+	var changed Threads
+	weights := make(map[int]float64, len(threads))
+	for _, t := range threads {
+		weights[t.ID] = BubbleWeight(t, now)
+		if last, ok := s.weights[t.ID]; ok && math.Abs(weights[t.ID]-last) < weightStep {
+			weights[t.ID] = last
+			continue
+		}
+		changed = append(changed, t)
+	}
+	s.weights = weights
+
+	for _, f := range s.feeds {
+		followed := make(map[int]float64)
+		for _, t := range changed {
+			if f.follows(t.Community) {
+				followed[t.ID] = weights[t.ID]
+			}
+		}
+		if len(followed) > 0 {
+			s.deliver(delivery{topics: []string{f.topic}, frames: []interface{}{Event{Type: WeightsUpdatedEvent, Seq: f.seq, Weights: followed}}})
+		}
+	}
+	return nil
+}
@@ -1,81 +1,254 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"sync"
 )
 
-func NewFFSFromPath(path string) (*FlatFileSystem, func(), error) {
-	db, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+const backupExtension = ".bak"
 
-	if err != nil {
-		return nil, nil, fmt.Errorf("Error opening %s file, %v", path, err)
-	}
+var missingDBErr = errors.New("database file is missing or empty")
 
-	ffs, err := NewFFS(db)
+func NewFFSFromPath(path string) (*FlatFileSystem, func(), error) {
+	ffs, err := openFFS(path)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Error initiating Flat File System from file, %s %v", path, err)
 	}
 
-	return ffs, func() { db.Close() }, nil
+	// Every change is synced as it is written, so there is nothing left to flush on close.
+	return ffs, func() {}, nil
 }
 
+// NewFFS opens a Flat File System on the file at file's path. The store replaces that file on
+// every change, so file itself is only read from.
 func NewFFS(file *os.File) (*FlatFileSystem, error) {
-	file.Seek(0, 0)
-	err := initialiseFlatFileDB(file)
+	ffs, err := openFFS(file.Name())
 	if err != nil {
-		return nil, fmt.Errorf("Unable to initialize file for FFS, %v", err)
+		return nil, fmt.Errorf("Unable to get threads from input, %v", err)
 	}
+	return ffs, nil
+}
 
-	threads, err := GetThreadsFromReader(file)
+// openFFS loads the database at path, renumbering threads that share an ID.
+func openFFS(path string) (*FlatFileSystem, error) {
+	threads, err := loadFlatFileDB(path)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to get threads from input, %v", err)
+		return nil, err
 	}
 
-	return &FlatFileSystem{database: json.NewEncoder(&FFSWriter{file: file}), threads: threads}, nil
+	f := &FlatFileSystem{path: path, threads: threads}
+	if repaired := threads.repairIDs(); repaired > 0 {
+		log.Printf("Gave %d threads in %s a new ID, as they shared theirs with another thread.", repaired, path)
+		if err := f.persist(); err != nil {
+			return nil, err
+		}
+	}
+	f.nextID = threads.nextID()
+	f.communities = indexCommunities(threads)
+	return f, nil
 }
 
-func initialiseFlatFileDB(file *os.File) error {
-	file.Seek(0, 0)
+// loadFlatFileDB reads the threads at path, starting a new database when there is none.
+// A missing, empty or unreadable file, as a crash may leave behind, is restored from the
+// backup of the last good version when there is one.
+func loadFlatFileDB(path string) (Threads, error) {
+	if err := removeTempFiles(path); err != nil {
+		return nil, err
+	}
+	if err := removeTempFiles(path + backupExtension); err != nil {
+		return nil, err
+	}
+
+	threads, err := readThreadsFile(path)
+	if err == nil {
+		return threads, nil
+	}
 
-	info, err := file.Stat()
+	backup, backupErr := readThreadsFile(path + backupExtension)
+	switch {
+	case backupErr == nil:
+		log.Printf("Restoring %s from its backup, %v", path, err)
+		return backup, writeThreadsFile(path, "", backup)
+	case err == missingDBErr && backupErr == missingDBErr:
+		return Threads{}, writeThreadsFile(path, "", Threads{})
+	case err == missingDBErr:
+		return nil, fmt.Errorf("%s is missing and its backup is unreadable, %v", path, backupErr)
+	default:
+		return nil, err
+	}
+}
 
+// readThreadsFile returns missingDBErr for a file that does not exist or is empty.
+func readThreadsFile(path string) (Threads, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, missingDBErr
+	}
 	if err != nil {
-		return fmt.Errorf("problem getting file info from file %s, %v", file.Name(), err)
+		return nil, fmt.Errorf("Error opening %s file, %v", path, err)
 	}
+	defer file.Close()
 
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("problem getting file info from file %s, %v", path, err)
+	}
 	if info.Size() == 0 {
-		file.Write([]byte("[]"))
-		file.Seek(0, 0)
+		return nil, missingDBErr
 	}
-	return nil
+
+	threads, err := readStoredThreads(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get threads from %s, %v", path, err)
+	}
+	return threads, nil
+}
+
+func writeThreadsFile(path, backup string, threads Threads) error {
+	return writeFileAtomic(path, backup, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(storeThreads(threads))
+	})
 }
 
 type FlatFileSystem struct {
-	database *json.Encoder
-	threads  Threads
+	mu          sync.RWMutex
+	path        string
+	threads     Threads
+	communities communityIndex
+	nextID      int
+}
+
+// persist must be called with mu held. The file being replaced is kept as the backup.
+func (f *FlatFileSystem) persist() error {
+	return writeThreadsFile(f.path, f.path+backupExtension, f.threads)
+}
+
+// update must be called with mu held. It applies change to thread id and writes the database,
+// putting the thread back as it was when the write fails.
+func (f *FlatFileSystem) update(id int, change func(Threads) error) error {
+	i := f.threads.indexOf(id)
+	if i < 0 {
+		return MissingThreadErr
+	}
+
+	previous := f.threads[i].clone()
+	if err := change(f.threads[i : i+1]); err != nil {
+		return err
+	}
+	if err := f.persist(); err != nil {
+		f.threads[i] = previous
+		return err
+	}
+	return nil
+}
+
+func (f *FlatFileSystem) GetThreads(ctx context.Context) (Threads, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.threads.live(), nil
+}
+
+func (f *FlatFileSystem) SaveThread(ctx context.Context, t Thread) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t.ID = f.nextID
+	f.threads = append(f.threads, t.clone())
+	if err := f.persist(); err != nil {
+		f.threads = f.threads[:len(f.threads)-1]
+		return Thread{}, err
+	}
+	f.communities.add(t, len(f.threads)-1)
+	f.nextID++
+	return t, nil
 }
 
-func (f *FlatFileSystem) GetThreads() Threads {
-	return f.threads
+func (f *FlatFileSystem) QueryThreads(ctx context.Context, query ThreadQuery) (ThreadPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ThreadPage{}, err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.threads.query(query, f.communities)
 }
 
-func (f *FlatFileSystem) SaveThread(t Thread) {
-	f.threads = append(f.threads, t)
-	f.database.Encode(f.threads)
+func (f *FlatFileSystem) GetThreadByID(ctx context.Context, id int) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.threads.byID(id)
 }
 
-type FFSWriter struct {
-	file *os.File
+func (f *FlatFileSystem) UpdateThread(ctx context.Context, t Thread) (edited Thread, err error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err = f.update(t.ID, func(ts Threads) (err error) {
+		edited, err = ts.edit(t)
+		return err
+	})
+	return edited, err
 }
 
-func NewFFSWriter(f *os.File) *FFSWriter {
-	return &FFSWriter{file: f}
+func (f *FlatFileSystem) DeleteThread(ctx context.Context, id int) (deleted Thread, err error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err = f.update(id, func(ts Threads) (err error) {
+		deleted, err = ts.remove(id)
+		return err
+	})
+	return deleted, err
 }
 
-func (w *FFSWriter) Write(p []byte) (n int, err error) {
-	w.file.Truncate(0)
-	w.file.Seek(0, 0)
-	return w.file.Write(p)
+func (f *FlatFileSystem) Vote(ctx context.Context, v Vote) (thread Thread, err error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err = f.update(v.ThreadID, func(ts Threads) (err error) {
+		thread, err = ts.vote(v)
+		return err
+	})
+	return thread, err
+}
+
+func (f *FlatFileSystem) SaveComment(ctx context.Context, c Comment) (saved Comment, err error) {
+	if err := ctx.Err(); err != nil {
+		return Comment{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err = f.update(c.ThreadID, func(ts Threads) (err error) {
+		saved, err = ts.addComment(c)
+		return err
+	})
+	return saved, err
+}
+
+func (f *FlatFileSystem) GetComments(ctx context.Context, threadID int) (Comments, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.threads.comments(threadID)
 }
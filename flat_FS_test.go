@@ -2,9 +2,12 @@ package server_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"server"
 	"testing"
 )
@@ -23,7 +26,7 @@ func TestFlatFileSystemStore(t *testing.T) {
 
 		store := getNewFFS(t, tmpfile)
 
-		threads := store.GetThreads()
+		threads := getThreads(t, store)
 		if len(threads) == 0 {
 			t.Fatal("no threads returned")
 		}
@@ -41,9 +44,9 @@ func TestFlatFileSystemStore(t *testing.T) {
 
 		store := getNewFFS(t, tmpfile)
 
-		store.SaveThread(testThread)
+		store.SaveThread(context.Background(), testThread)
 
-		threads := store.GetThreads()
+		threads := getThreads(t, store)
 		if len(threads) == 0 {
 			t.Fatal("no threads returned")
 		}
@@ -64,9 +67,9 @@ func TestFlatFileSystemStore(t *testing.T) {
 
 		store := getNewFFS(t, tmpfile)
 
-		store.SaveThread(testThread)
+		store.SaveThread(context.Background(), testThread)
 
-		threads := store.GetThreads()
+		threads := getThreads(t, store)
 		if len(threads) == 0 {
 			t.Fatal("no threads returned")
 		}
@@ -74,26 +77,368 @@ func TestFlatFileSystemStore(t *testing.T) {
 		want := append(originalThreads, testThread)
 		assertThreads(t, threads, want)
 	})
-}
 
-func TestDatabaseWriter(t *testing.T) {
-	file, clean := createTempFile(t)
-	defer clean()
-	file.Write([]byte("12345"))
+	t.Run("file system persists votes", func(t *testing.T) {
+		originalThreads := []server.Thread{
+			{ID: 0, Content: "Hi", User: "Anna"},
+			{ID: 1, Content: "Bye", User: "Bob"},
+		}
+
+		tmpfile, removeFile := createTempFile(t)
+		defer removeFile()
+
+		tmpfile.Write(ThreadsToBytes(t, originalThreads))
+
+		store := getNewFFS(t, tmpfile)
+
+		got, err := store.Vote(context.Background(), server.Vote{ThreadID: 1, User: "Anna", Value: 1})
+		if err != nil {
+			t.Fatalf("unexpected error voting, %v", err)
+		}
+		want := server.Thread{ID: 1, Content: "Bye", User: "Bob", UpVotesCount: 1, Voters: map[string]int{"Anna": 1}}
+		assertThreadExceptID(t, got, want)
+
+		_, err = store.Vote(context.Background(), server.Vote{ThreadID: 2, User: "Anna", Value: 1})
+		if err != server.MissingThreadErr {
+			t.Errorf("wanted %v when voting on missing thread, got %v", server.MissingThreadErr, err)
+		}
+
+		reloaded := getNewFFS(t, tmpfile)
+		assertThreads(t, getThreads(t, reloaded), []server.Thread{originalThreads[0], want})
+	})
+
+	t.Run("file system keeps one vote per user", func(t *testing.T) {
+		tmpfile, removeFile := createTempFile(t)
+		defer removeFile()
+
+		tmpfile.Write(ThreadsToBytes(t, []server.Thread{{ID: 0, Content: "Hi", User: "Anna"}}))
+
+		store := getNewFFS(t, tmpfile)
+
+		testcases := []struct {
+			name string
+			vote server.Vote
+			want server.Thread
+		}{
+			{
+				name: "first upvote is counted",
+				vote: server.Vote{User: "Bob", Value: 1},
+				want: server.Thread{Content: "Hi", User: "Anna", UpVotesCount: 1, Voters: map[string]int{"Bob": 1}},
+			},
+			{
+				name: "repeated upvote is ignored",
+				vote: server.Vote{User: "Bob", Value: 1},
+				want: server.Thread{Content: "Hi", User: "Anna", UpVotesCount: 1, Voters: map[string]int{"Bob": 1}},
+			},
+			{
+				name: "another user's downvote is counted",
+				vote: server.Vote{User: "Carl", Value: -1},
+				want: server.Thread{Content: "Hi", User: "Anna", UpVotesCount: 1, DownVotesCount: 1, Voters: map[string]int{"Bob": 1, "Carl": -1}},
+			},
+			{
+				name: "switching moves the vote",
+				vote: server.Vote{User: "Bob", Value: -1},
+				want: server.Thread{Content: "Hi", User: "Anna", DownVotesCount: 2, Voters: map[string]int{"Bob": -1, "Carl": -1}},
+			},
+			{
+				name: "retracting removes the vote",
+				vote: server.Vote{User: "Carl", Value: 0},
+				want: server.Thread{Content: "Hi", User: "Anna", DownVotesCount: 1, Voters: map[string]int{"Bob": -1}},
+			},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				got, err := store.Vote(context.Background(), tc.vote)
+				if err != nil {
+					t.Fatalf("unexpected error voting, %v", err)
+				}
+				assertThreadExceptID(t, got, tc.want)
+			})
+		}
+
+		reloaded := getNewFFS(t, tmpfile)
+		assertThreads(t, getThreads(t, reloaded), []server.Thread{testcases[len(testcases)-1].want})
+	})
+
+	t.Run("file system persists nested comments", func(t *testing.T) {
+		tmpfile, removeFile := createTempFile(t)
+		defer removeFile()
+
+		tmpfile.Write(ThreadsToBytes(t, []server.Thread{{ID: 0, Content: "Hi", User: "Anna"}}))
+
+		store := getNewFFS(t, tmpfile)
+
+		store.SaveComment(context.Background(), server.Comment{ThreadID: 0, Content: "Hello", User: "Bob"})
+		store.SaveComment(context.Background(), server.Comment{ThreadID: 0, ParentID: 1, Content: "Hello again", User: "Anna"})
+		store.Vote(context.Background(), server.Vote{ThreadID: 0, CommentID: 2, User: "Bob", Value: 1})
+
+		_, err := store.SaveComment(context.Background(), server.Comment{ThreadID: 0, ParentID: 5, Content: "Hm?", User: "Carl"})
+		if err != server.MissingCommentErr {
+			t.Errorf("wanted %v when replying to missing comment, got %v", server.MissingCommentErr, err)
+		}
+
+		want := server.Comments{
+			{ID: 1, ThreadID: 0, Content: "Hello", User: "Bob"},
+			{ID: 2, ThreadID: 0, ParentID: 1, Depth: 1, Content: "Hello again", User: "Anna", UpVotesCount: 1, Voters: map[string]int{"Bob": 1}},
+		}
+
+		reloaded := getNewFFS(t, tmpfile)
+		got, err := reloaded.GetComments(context.Background(), 0)
+		if err != nil {
+			t.Fatalf("unexpected error getting comments, %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got comments %v want %v", got, want)
+		}
+	})
+
+	t.Run("file system persists edits and deletions", func(t *testing.T) {
+		tmpfile, removeFile := createTempFile(t)
+		defer removeFile()
+
+		tmpfile.Write(ThreadsToBytes(t, []server.Thread{
+			{ID: 0, Content: "Hi", User: "Anna"},
+			{ID: 1, Content: "Bye", User: "Bob", UpVotesCount: 1},
+		}))
+
+		store := getNewFFS(t, tmpfile)
+
+		edited, err := store.UpdateThread(context.Background(), server.Thread{ID: 1, Content: "Bye now", User: "Mallory"})
+		if err != nil {
+			t.Fatalf("unexpected error editing, %v", err)
+		}
+		want := server.Thread{ID: 1, Content: "Bye now", User: "Bob", UpVotesCount: 1}
+		assertThreadExceptID(t, edited, want)
+
+		if _, err := store.DeleteThread(context.Background(), 0); err != nil {
+			t.Fatalf("unexpected error deleting, %v", err)
+		}
+		if _, err := store.DeleteThread(context.Background(), 0); err != server.MissingThreadErr {
+			t.Errorf("wanted %v when deleting a deleted thread, got %v", server.MissingThreadErr, err)
+		}
+
+		reloaded := getNewFFS(t, tmpfile)
+		assertThreads(t, getThreads(t, reloaded), []server.Thread{want})
+		if _, err := reloaded.GetThreadByID(context.Background(), 0); err != server.MissingThreadErr {
+			t.Errorf("wanted %v getting a deleted thread, got %v", server.MissingThreadErr, err)
+		}
+	})
+
+	t.Run("file system numbers new threads after every thread ever saved", func(t *testing.T) {
+		tmpfile, removeFile := createTempFile(t)
+		defer removeFile()
+
+		tmpfile.Write(ThreadsToBytes(t, []server.Thread{
+			{ID: 0, Content: "Hi", User: "Anna"},
+			{ID: 4, Content: "Bye", User: "Bob"},
+		}))
+
+		store := getNewFFS(t, tmpfile)
+		store.DeleteThread(context.Background(), 4)
+
+		saved, err := store.SaveThread(context.Background(), server.Thread{ID: 1, Content: "Hello", User: "Carl"})
+		if err != nil {
+			t.Fatalf("unexpected error saving, %v", err)
+		}
+		if saved.ID != 5 {
+			t.Errorf("got ID %d, want 5", saved.ID)
+		}
+
+		reloaded := getNewFFS(t, tmpfile)
+		saved, _ = reloaded.SaveThread(context.Background(), server.Thread{Content: "Hello again", User: "Carl"})
+		if saved.ID != 6 {
+			t.Errorf("got ID %d after reloading, want 6", saved.ID)
+		}
+	})
+
+	t.Run("file system renumbers threads that share an ID", func(t *testing.T) {
+		tmpfile, removeFile := createTempFile(t)
+		defer removeFile()
+
+		tmpfile.Write(ThreadsToBytes(t, []server.Thread{
+			{ID: 0, Content: "Hi", User: "Anna"},
+			{ID: 0, Content: "Bye", User: "Bob", Comments: server.Comments{{ID: 1, ThreadID: 0, Content: "Hello", User: "Carl"}}},
+			{ID: 1, Content: "Hm", User: "Carl"},
+		}))
+
+		want := []server.Thread{
+			{ID: 0, Content: "Hi", User: "Anna"},
+			{ID: 2, Content: "Bye", User: "Bob", Comments: server.Comments{{ID: 1, ThreadID: 2, Content: "Hello", User: "Carl"}}},
+			{ID: 1, Content: "Hm", User: "Carl"},
+		}
+		getNewFFS(t, tmpfile)
+
+		reloaded := getNewFFS(t, tmpfile)
+		if got := getThreads(t, reloaded); !reflect.DeepEqual([]server.Thread(got), want) {
+			t.Errorf("got threads %v want %v", got, want)
+		}
+	})
+
+	t.Run("file system pages carry on after a deleted thread", func(t *testing.T) {
+		tmpfile, removeFile := createTempFile(t)
+		defer removeFile()
+
+		tmpfile.Write(ThreadsToBytes(t, []server.Thread{
+			{ID: 0, Content: "Hi", User: "Anna"},
+			{ID: 1, Content: "Bye", User: "Bob"},
+			{ID: 2, Content: "Hm", User: "Carl"},
+		}))
+
+		store := getNewFFS(t, tmpfile)
+		first, err := store.QueryThreads(context.Background(), server.ThreadQuery{Limit: 2})
+		if err != nil {
+			t.Fatalf("unexpected error querying, %v", err)
+		}
+		assertThreadIDs(t, first.Threads, []int{0, 1})
+
+		store.DeleteThread(context.Background(), 1)
+		second, err := store.QueryThreads(context.Background(), server.ThreadQuery{Limit: 2, Cursor: first.NextCursor})
+		if err != nil {
+			t.Fatalf("unexpected error querying, %v", err)
+		}
+		assertThreadIDs(t, second.Threads, []int{2})
+		if second.NextCursor != "" {
+			t.Errorf("got cursor %q on the last page", second.NextCursor)
+		}
+	})
 
-	writer := server.NewFFSWriter(file)
-	writer.Write([]byte("abc"))
+	t.Run("file system persists and queries communities", func(t *testing.T) {
+		tmpfile, removeFile := createTempFile(t)
+		defer removeFile()
 
-	file.Seek(0, 0)
-	newFileContents, _ := ioutil.ReadAll(file)
+		tmpfile.Write(ThreadsToBytes(t, []server.Thread{
+			{ID: 0, Content: "Hi", User: "Anna", Community: "golang"},
+			{ID: 1, Content: "Bye", User: "Bob"},
+		}))
 
-	got := string(newFileContents)
-	want := "abc"
+		store := getNewFFS(t, tmpfile)
+		store.SaveThread(context.Background(), server.Thread{Content: "Hm", User: "Carl", Community: "golang"})
+		store.SaveThread(context.Background(), server.Thread{Content: "Oh", User: "Dina", Community: "rust"})
+
+		reloaded := getNewFFS(t, tmpfile)
+		for _, s := range []server.ThreadStoreV2{store, reloaded} {
+			page, err := s.QueryThreads(context.Background(), server.ThreadQuery{Community: "golang", Limit: 1})
+			if err != nil {
+				t.Fatalf("unexpected error querying, %v", err)
+			}
+			assertThreadIDs(t, page.Threads, []int{0})
+
+			page, err = s.QueryThreads(context.Background(), server.ThreadQuery{Community: "golang", Cursor: page.NextCursor})
+			if err != nil {
+				t.Fatalf("unexpected error querying, %v", err)
+			}
+			assertThreadIDs(t, page.Threads, []int{2})
+		}
+	})
+}
+
+func TestFlatFileSystemRecovery(t *testing.T) {
+	original := []server.Thread{{ID: 0, Content: "Hi", User: "Anna"}}
+	saved := server.Thread{ID: 1, Content: "Bye", User: "Bob"}
 
-	if got != want {
-		t.Errorf("want %q got %q", want, got)
+	// setUp leaves a database holding original and saved, with original alone in its backup.
+	setUp := func(t *testing.T) (string, func()) {
+		path, clean := createTempDBPath(t)
+		if err := ioutil.WriteFile(path, ThreadsToBytes(t, original), 0666); err != nil {
+			t.Fatalf("could not write database, %v", err)
+		}
+		store, _, err := server.NewFFSFromPath(path)
+		if err != nil {
+			t.Fatalf("Unable to make new FFS, %v", err)
+		}
+		store.SaveThread(context.Background(), saved)
+		return path, clean
 	}
 
+	testcases := []struct {
+		name  string
+		crash func(t *testing.T, path string)
+		want  []server.Thread
+	}{
+		{
+			name:  "reopens the latest version",
+			crash: func(t *testing.T, path string) {},
+			want:  append(original, saved),
+		},
+		{
+			name: "ignores a temp file left by an interrupted write",
+			crash: func(t *testing.T, path string) {
+				ioutil.WriteFile(path+".tmp-123", []byte(`[{"ID": 2, "Cont`), 0666)
+			},
+			want: append(original, saved),
+		},
+		{
+			name: "restores a truncated database from its backup",
+			crash: func(t *testing.T, path string) {
+				os.Truncate(path, 0)
+			},
+			want: original,
+		},
+		{
+			name: "restores a half-written database from its backup",
+			crash: func(t *testing.T, path string) {
+				os.Truncate(path, 10)
+			},
+			want: original,
+		},
+		{
+			name: "keeps the latest version when a crash interrupts its backup",
+			crash: func(t *testing.T, path string) {
+				os.Link(path, path+".bak.tmp-123")
+			},
+			want: append(original, saved),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			path, clean := setUp(t)
+			defer clean()
+
+			tc.crash(t, path)
+
+			store, _, err := server.NewFFSFromPath(path)
+			if err != nil {
+				t.Fatalf("Unable to recover FFS, %v", err)
+			}
+			assertThreads(t, getThreads(t, store), tc.want)
+
+			leftovers, _ := filepath.Glob(path + ".tmp-*")
+			backupLeftovers, _ := filepath.Glob(path + ".bak.tmp-*")
+			leftovers = append(leftovers, backupLeftovers...)
+			if len(leftovers) != 0 {
+				t.Errorf("temp files were left behind, %v", leftovers)
+			}
+		})
+	}
+
+	t.Run("backup matches the previous version", func(t *testing.T) {
+		path, clean := setUp(t)
+		defer clean()
+
+		backup, err := os.Open(path + ".bak")
+		if err != nil {
+			t.Fatalf("could not open backup, %v", err)
+		}
+		defer backup.Close()
+		got, err := server.GetThreadsFromReader(backup)
+		if err != nil {
+			t.Fatalf("could not read backup, %v", err)
+		}
+		assertThreads(t, got, original)
+	})
+
+	t.Run("refuses a corrupt database without a backup", func(t *testing.T) {
+		path, clean := createTempDBPath(t)
+		defer clean()
+		ioutil.WriteFile(path, []byte(`[{"ID": 0, "Cont`), 0666)
+
+		_, _, err := server.NewFFSFromPath(path)
+		if err == nil {
+			t.Error("wanted an error opening a corrupt database")
+		}
+	})
 }
 
 func createTempFile(t testing.TB) (*os.File, func()) {
@@ -133,3 +478,12 @@ func getNewFFS(t testing.TB, file *os.File) *server.FlatFileSystem {
 
 	return ffs
 }
+
+func getThreads(t testing.TB, store server.ThreadStoreV2) server.Threads {
+	t.Helper()
+	threads, err := store.GetThreads(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting threads, %v", err)
+	}
+	return threads
+}
@@ -1,13 +1,101 @@
 package server
 
+import (
+	"context"
+	"sync"
+)
+
 type MemStore struct {
-	threads Threads
+	mu          sync.RWMutex
+	threads     Threads
+	communities communityIndex
+	nextID      int
+}
+
+func (s *MemStore) SaveThread(ctx context.Context, thread Thread) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	thread.ID = s.nextID
+	s.nextID++
+	s.threads = append(s.threads, thread.clone())
+	if s.communities == nil {
+		s.communities = make(communityIndex)
+	}
+	s.communities.add(thread, len(s.threads)-1)
+	return thread, nil
+}
+
+func (s *MemStore) GetThreads(ctx context.Context) (Threads, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.threads.live(), nil
+}
+
+func (s *MemStore) QueryThreads(ctx context.Context, query ThreadQuery) (ThreadPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ThreadPage{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.threads.query(query, s.communities)
+}
+
+func (s *MemStore) GetThreadByID(ctx context.Context, id int) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.threads.byID(id)
+}
+
+func (s *MemStore) UpdateThread(ctx context.Context, thread Thread) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.threads.edit(thread)
+}
+
+func (s *MemStore) DeleteThread(ctx context.Context, id int) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.threads.remove(id)
+}
+
+func (s *MemStore) Vote(ctx context.Context, v Vote) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.threads.vote(v)
 }
 
-func (s *MemStore) SaveThread(thread Thread) {
-	s.threads = append(s.threads, thread)
+func (s *MemStore) SaveComment(ctx context.Context, c Comment) (Comment, error) {
+	if err := ctx.Err(); err != nil {
+		return Comment{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.threads.addComment(c)
 }
 
-func (s *MemStore) GetThreads() Threads {
-	return s.threads
+func (s *MemStore) GetComments(ctx context.Context, threadID int) (Comments, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.threads.comments(threadID)
 }
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+const (
+	ThreadMessage   = "thread"
+	VoteMessage     = "vote"
+	CommentMessage  = "comment"
+	PingMessage     = "ping"
+	SnapshotMessage = "snapshot"
+	ResumeMessage   = "resume"
+
+	AckMessage   = "ack"
+	PongMessage  = "pong"
+	ErrorMessage = "error"
+
+	UnknownTypeCode  = "unknown_type"
+	BadPayloadCode   = "bad_payload"
+	RejectedCode     = "rejected"
+	StoreFailureCode = "store_failure"
+
+	EmptyContentCode     = "empty_content"
+	MissingUserCode      = "missing_user"
+	InvalidVoteCode      = "invalid_vote"
+	MissingVoterCode     = "missing_voter"
+	EmptyCommentCode     = "empty_comment"
+	MissingCommenterCode = "missing_commenter"
+	MissingThreadCode    = "missing_thread"
+	MissingCommentCode   = "missing_comment"
+	InvalidCommunityCode = "invalid_community"
+	InvalidOperationCode = "invalid_operation"
+	InvalidRevisionCode  = "invalid_revision"
+	InvalidPositionCode  = "invalid_position"
+)
+
+// Envelope wraps every message exchanged with chat clients. Type selects the handler for an
+// inbound message, and ID is copied onto the reply sent back for it. Messages are acked only
+// when they carry an ID, while errors and pongs are always sent.
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// MessageError is the payload of an error message.
+type MessageError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"` // The payload field that failed validation, if any.
+	Message string `json:"message"`
+}
+
+// validationErrors gives the code, and the payload field to fix, for every error a handler
+// can reject a message with. Other errors are reported with RejectedCode.
+var validationErrors = map[error]MessageError{
+	EmptyContentErr:     {Code: EmptyContentCode, Field: "Content"},
+	MissingUserErr:      {Code: MissingUserCode, Field: "User"},
+	InvalidVoteErr:      {Code: InvalidVoteCode, Field: "Value"},
+	MissingVoterErr:     {Code: MissingVoterCode, Field: "User"},
+	EmptyCommentErr:     {Code: EmptyCommentCode, Field: "Content"},
+	MissingCommenterErr: {Code: MissingCommenterCode, Field: "User"},
+	MissingThreadErr:    {Code: MissingThreadCode, Field: "ThreadID"},
+	MissingCommentErr:   {Code: MissingCommentCode},
+	InvalidCommunityErr: {Code: InvalidCommunityCode, Field: "Community"},
+	InvalidOperationErr: {Code: InvalidOperationCode, Field: "ops"},
+	InvalidRevisionErr:  {Code: InvalidRevisionCode, Field: "revision"},
+	InvalidPositionErr:  {Code: InvalidPositionCode, Field: "cursor"},
+}
+
+// NewMessageError describes err for the client whose message caused it.
+func NewMessageError(err error) MessageError {
+	if e, ok := validationErrors[err]; ok {
+		e.Message = err.Error()
+		return e
+	}
+
+	if _, ok := err.(payloadError); ok {
+		return MessageError{Code: BadPayloadCode, Message: err.Error()}
+	}
+	var storeErr StoreError
+	if errors.As(err, &storeErr) {
+		return MessageError{Code: StoreFailureCode, Message: StoreFailureErrMsg}
+	}
+	return MessageError{Code: RejectedCode, Message: err.Error()}
+}
+
+type resumePayload struct {
+	Since uint64 `json:"since"`
+}
+
+// messageHandler handles the payload of one type of message, returning the payload of its ack.
+// A handler that returns ackLater replies to message id itself once it has been processed.
+type messageHandler func(s *Server, client *ClientWS, id string, payload json.RawMessage) (interface{}, error)
+
+type ackLaterResult struct{}
+
+var ackLater = ackLaterResult{}
+
+var messageHandlers = map[string]messageHandler{
+	ThreadMessage:   (*Server).handleThreadMessage,
+	VoteMessage:     (*Server).handleVoteMessage,
+	CommentMessage:  (*Server).handleCommentMessage,
+	PingMessage:     (*Server).handlePingMessage,
+	SnapshotMessage: (*Server).handleSnapshotMessage,
+	ResumeMessage:   (*Server).handleResumeMessage,
+}
+
+// ParseEnvelope reads a frame sent by a chat client. Frames without a type or payload are
+// treated as a bare Thread, as sent by clients that predate the envelope. Keys are matched
+// exactly, as encoding/json would otherwise read the ID of a bare Thread as the envelope's id.
+func ParseEnvelope(frame []byte) (Envelope, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(frame, &fields); err != nil {
+		return Envelope{}, fmt.Errorf("problem parsing message, %v", err)
+	}
+	_, typed := fields["type"]
+	payload, ok := fields["payload"]
+	if !typed && !ok {
+		return Envelope{Type: ThreadMessage, Payload: frame}, nil
+	}
+
+	env := Envelope{Payload: payload}
+	if raw, ok := fields["id"]; ok {
+		if err := json.Unmarshal(raw, &env.ID); err != nil {
+			return env, fmt.Errorf("problem parsing message id, %v", err)
+		}
+	}
+	if typed {
+		if err := json.Unmarshal(fields["type"], &env.Type); err != nil {
+			return env, fmt.Errorf("problem parsing message type, %v", err)
+		}
+	}
+	return env, nil
+}
+
+// dispatch routes a frame to the handler for its type and replies with an ack or an error.
+func (s *Server) dispatch(client *ClientWS, frame []byte) {
+	env, err := ParseEnvelope(frame)
+	if err != nil {
+		s.replyError(client, env.ID, BadPayloadCode, err)
+		return
+	}
+
+	handle, ok := messageHandlers[env.Type]
+	if !ok {
+		s.replyError(client, env.ID, UnknownTypeCode, fmt.Errorf("unknown message type %q", env.Type))
+		return
+	}
+
+	result, err := handle(s, client, env.ID, env.Payload)
+	if err != nil {
+		s.reply(client, ErrorMessage, env.ID, NewMessageError(err))
+		return
+	}
+	if result == ackLater {
+		return
+	}
+
+	if env.Type == PingMessage {
+		s.reply(client, PongMessage, env.ID, result)
+	} else if env.ID != "" {
+		s.reply(client, AckMessage, env.ID, result)
+	}
+}
+
+func (s *Server) reply(client *ClientWS, replyType, id string, payload interface{}) {
+	var raw json.RawMessage
+	if payload != nil {
+		var err error
+		raw, err = json.Marshal(payload)
+		if err != nil {
+			log.Printf("Unable to encode %s payload, %v", replyType, err)
+			return
+		}
+	}
+
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	s.deliver(delivery{client: client, frames: []interface{}{Envelope{Type: replyType, ID: id, Payload: raw}}})
+}
+
+func (s *Server) replyError(client *ClientWS, id, code string, err error) {
+	s.reply(client, ErrorMessage, id, MessageError{Code: code, Message: err.Error()})
+}
+
+// payloadError is returned by handlers for a payload that could not be decoded.
+type payloadError struct {
+	err error
+}
+
+func (e payloadError) Error() string {
+	return fmt.Sprintf("%s: %v", UnreadablePayloadErrMsg, e.err)
+}
+
+func decodePayload(payload json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(payload, v); err != nil {
+		return payloadError{err}
+	}
+	return nil
+}
+
+// handleThreadMessage queues a new thread for the threadSaver, which acks it with the saved
+// thread after the thread_created event, or replies with an error when it cannot be saved.
+func (s *Server) handleThreadMessage(client *ClientWS, id string, payload json.RawMessage) (interface{}, error) {
+	var t Thread
+	if err := decodePayload(payload, &t); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkThread(t); err != nil {
+		return nil, err
+	}
+	if err := s.queueThread(threadRequest{thread: t, client: client, id: id}); err != nil {
+		return nil, err
+	}
+	return ackLater, nil
+}
+
+func (s *Server) handleVoteMessage(client *ClientWS, id string, payload json.RawMessage) (interface{}, error) {
+	var v Vote
+	if err := decodePayload(payload, &v); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkVote(v); err != nil {
+		return nil, err
+	}
+	return s.vote(context.Background(), v)
+}
+
+func (s *Server) handleCommentMessage(client *ClientWS, id string, payload json.RawMessage) (interface{}, error) {
+	var c Comment
+	if err := decodePayload(payload, &c); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkComment(c); err != nil {
+		return nil, err
+	}
+	return s.saveComment(context.Background(), c)
+}
+
+func (s *Server) handlePingMessage(client *ClientWS, id string, payload json.RawMessage) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *Server) handleSnapshotMessage(client *ClientWS, id string, payload json.RawMessage) (interface{}, error) {
+	return nil, s.resend(client, 0, false)
+}
+
+func (s *Server) handleResumeMessage(client *ClientWS, id string, payload json.RawMessage) (interface{}, error) {
+	var r resumePayload
+	if err := decodePayload(payload, &r); err != nil {
+		return nil, err
+	}
+
+	return nil, s.resend(client, r.Since, true)
+}
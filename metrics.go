@@ -0,0 +1,11 @@
+package server
+
+import "expvar"
+
+// Metrics are published with expvar. They are not served by Server, whose routes are public;
+// cmd/server serves them as JSON on /debug/vars of a separate, internal listener.
+var (
+	slowConsumerEvictions = expvar.NewInt("ws_slow_consumer_evictions")
+	openPairDocuments     = expvar.NewInt("pair_documents_open")
+	pairDocumentEvictions = expvar.NewInt("pair_document_evictions")
+)
@@ -0,0 +1,336 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"unicode/utf8"
+)
+
+var InvalidOperationErr = errors.New("Operation does not match the length of the document, or has a component that is not exactly one of retain, insert or delete.")
+
+// Operation is an edit of a whole document, made of components that walk it from start to end:
+// Retain skips characters, Insert adds text and Delete removes characters. Lengths count
+// characters (Unicode code points), and the retained and deleted characters of an operation
+// must add up to the length of the document it applies to.
+type Operation []OpComponent
+type OpComponent struct {
+	Retain int    `json:"retain,omitempty"`
+	Insert string `json:"insert,omitempty"`
+	Delete int    `json:"delete,omitempty"`
+}
+
+func (c OpComponent) valid() bool {
+	set := 0
+	if c.Retain > 0 {
+		set++
+	}
+	if c.Insert != "" {
+		set++
+	}
+	if c.Delete > 0 {
+		set++
+	}
+	return set == 1 && c.Retain >= 0 && c.Delete >= 0
+}
+
+// length returns how many characters of the document the component walks over, or inserts.
+func (c OpComponent) length() int {
+	switch {
+	case c.Retain > 0:
+		return c.Retain
+	case c.Delete > 0:
+		return c.Delete
+	}
+	return utf8.RuneCountInString(c.Insert)
+}
+
+// Valid reports whether every component of op is exactly one of retain, insert or delete.
+func (op Operation) Valid() bool {
+	for _, c := range op {
+		if !c.valid() {
+			return false
+		}
+	}
+	return true
+}
+
+// BaseLength is the length of the documents op applies to, or -1 when op has a negative length
+// or its lengths add up to more than any document can hold.
+func (op Operation) BaseLength() int {
+	n := 0
+	for _, c := range op {
+		if n = addLength(addLength(n, c.Retain), c.Delete); n < 0 {
+			return -1
+		}
+	}
+	return n
+}
+
+// TargetLength is the length of the document op produces, or -1 like BaseLength.
+func (op Operation) TargetLength() int {
+	n := 0
+	for _, c := range op {
+		if n = addLength(addLength(n, c.Retain), utf8.RuneCountInString(c.Insert)); n < 0 {
+			return -1
+		}
+	}
+	return n
+}
+
+// addLength returns n plus length, or -1 when either is negative or the sum overflows.
+func addLength(n, length int) int {
+	if n < 0 || length < 0 || length > math.MaxInt-n {
+		return -1
+	}
+	return n + length
+}
+
+// retain, insert and delete append a component to op, merging it with the last one when they
+// are of the same kind. An insert right after a delete is put before it, so that equal edits
+// are always written the same way.
+func (op Operation) retain(n int) Operation {
+	if n <= 0 {
+		return op
+	}
+	if last := len(op) - 1; last >= 0 && op[last].Retain > 0 {
+		op[last].Retain += n
+		return op
+	}
+	return append(op, OpComponent{Retain: n})
+}
+
+func (op Operation) insert(text string) Operation {
+	if text == "" {
+		return op
+	}
+	last := len(op) - 1
+	if last >= 0 && op[last].Insert != "" {
+		op[last].Insert += text
+		return op
+	}
+	if last >= 0 && op[last].Delete > 0 {
+		if last > 0 && op[last-1].Insert != "" {
+			op[last-1].Insert += text
+			return op
+		}
+		op = append(op, op[last])
+		op[last] = OpComponent{Insert: text}
+		return op
+	}
+	return append(op, OpComponent{Insert: text})
+}
+
+func (op Operation) delete(n int) Operation {
+	if n <= 0 {
+		return op
+	}
+	if last := len(op) - 1; last >= 0 && op[last].Delete > 0 {
+		op[last].Delete += n
+		return op
+	}
+	return append(op, OpComponent{Delete: n})
+}
+
+// Apply returns text edited by op.
+func (op Operation) Apply(text string) (string, error) {
+	doc := []rune(text)
+	if !op.Valid() || op.BaseLength() != len(doc) {
+		return "", InvalidOperationErr
+	}
+
+	edited := make([]rune, 0, op.TargetLength())
+	i := 0
+	for _, c := range op {
+		// Lengths come from clients, so every one is checked against what is left of the
+		// document rather than trusting their sum.
+		if c.Retain > len(doc)-i || c.Delete > len(doc)-i {
+			return "", InvalidOperationErr
+		}
+		switch {
+		case c.Retain > 0:
+			edited = append(edited, doc[i:i+c.Retain]...)
+			i += c.Retain
+		case c.Insert != "":
+			edited = append(edited, []rune(c.Insert)...)
+		case c.Delete > 0:
+			i += c.Delete
+		}
+	}
+	return string(edited), nil
+}
+
+// componentReader walks the components of an operation, handing out parts of a component when
+// the other operation's component is shorter.
+type componentReader struct {
+	op   Operation
+	next int
+	part OpComponent // What is left of the component being read; the zero value once op is read.
+}
+
+func newComponentReader(op Operation) *componentReader {
+	r := &componentReader{op: op}
+	r.advance()
+	return r
+}
+
+func (r *componentReader) advance() {
+	r.part = OpComponent{}
+	if r.next < len(r.op) {
+		r.part = r.op[r.next]
+		r.next++
+	}
+}
+
+func (r *componentReader) done() bool {
+	return r.part == OpComponent{}
+}
+
+// take consumes up to n characters of the current retain or delete, or of an insert's text,
+// and returns them.
+func (r *componentReader) take(n int) OpComponent {
+	c := r.part
+	switch {
+	case c.Retain > 0:
+		if n < c.Retain {
+			r.part.Retain -= n
+			return OpComponent{Retain: n}
+		}
+	case c.Delete > 0:
+		if n < c.Delete {
+			r.part.Delete -= n
+			return OpComponent{Delete: n}
+		}
+	default:
+		if text := []rune(c.Insert); n < len(text) {
+			r.part.Insert = string(text[n:])
+			return OpComponent{Insert: string(text[:n])}
+		}
+	}
+	r.advance()
+	return c
+}
+
+// Transform takes two operations made concurrently on the same document and returns aPrime
+// and bPrime, such that applying a then bPrime gives the same document as applying b then
+// aPrime. When both insert at the same place, a's text comes first.
+func Transform(a, b Operation) (aPrime, bPrime Operation, err error) {
+	if !a.Valid() || !b.Valid() || a.BaseLength() < 0 || a.BaseLength() != b.BaseLength() {
+		return nil, nil, InvalidOperationErr
+	}
+
+	ra, rb := newComponentReader(a), newComponentReader(b)
+	for !ra.done() || !rb.done() {
+		switch {
+		case ra.part.Insert != "":
+			insert := ra.take(ra.part.length())
+			aPrime = aPrime.insert(insert.Insert)
+			bPrime = bPrime.retain(insert.length())
+			continue
+		case rb.part.Insert != "":
+			insert := rb.take(rb.part.length())
+			aPrime = aPrime.retain(insert.length())
+			bPrime = bPrime.insert(insert.Insert)
+			continue
+		case ra.done() || rb.done():
+			return nil, nil, InvalidOperationErr
+		}
+
+		n := min(ra.part.length(), rb.part.length())
+		ca, cb := ra.take(n), rb.take(n)
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			aPrime = aPrime.retain(n)
+			bPrime = bPrime.retain(n)
+		case ca.Delete > 0 && cb.Retain > 0:
+			aPrime = aPrime.delete(n)
+		case ca.Retain > 0 && cb.Delete > 0:
+			bPrime = bPrime.delete(n)
+		}
+		// When both delete the same characters, neither needs to delete them again.
+	}
+	return aPrime, bPrime, nil
+}
+
+// Compose returns a single operation with the effect of applying a and then b.
+func Compose(a, b Operation) (Operation, error) {
+	if !a.Valid() || !b.Valid() || a.TargetLength() < 0 || a.TargetLength() != b.BaseLength() {
+		return nil, InvalidOperationErr
+	}
+
+	var composed Operation
+	ra, rb := newComponentReader(a), newComponentReader(b)
+	for !ra.done() || !rb.done() {
+		switch {
+		case ra.part.Delete > 0:
+			composed = composed.delete(ra.take(ra.part.length()).Delete)
+			continue
+		case rb.part.Insert != "":
+			composed = composed.insert(rb.take(rb.part.length()).Insert)
+			continue
+		case ra.done() || rb.done():
+			return nil, InvalidOperationErr
+		}
+
+		n := min(ra.part.length(), rb.part.length())
+		ca, cb := ra.take(n), rb.take(n)
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			composed = composed.retain(n)
+		case ca.Retain > 0 && cb.Delete > 0:
+			composed = composed.delete(n)
+		case ca.Insert != "" && cb.Retain > 0:
+			composed = composed.insert(ca.Insert)
+		}
+		// Text a inserts and b deletes never makes it into the composed operation.
+	}
+	return composed, nil
+}
+
+// TransformIndex returns where position index of a document is once op is applied to it. Text
+// inserted at index pushes it along; when the character before index is deleted, it moves to
+// where the deletion starts.
+func (op Operation) TransformIndex(index int) int {
+	moved, left := index, index
+	for _, c := range op {
+		if left < 0 {
+			break
+		}
+		switch {
+		case c.Retain > 0:
+			left -= c.Retain
+		case c.Insert != "":
+			moved += utf8.RuneCountInString(c.Insert)
+		case c.Delete > 0:
+			moved -= min(left, c.Delete)
+			left -= c.Delete
+		}
+	}
+	return moved
+}
+
+// diff returns an operation turning from into to, which replaces the characters between their
+// common prefix and suffix.
+func diff(from, to string) Operation {
+	a, b := []rune(from), []rune(to)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var op Operation
+	op = op.retain(prefix)
+	op = op.insert(string(b[prefix : len(b)-suffix]))
+	op = op.delete(len(a) - prefix - suffix)
+	return op.retain(suffix)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
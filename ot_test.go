@@ -0,0 +1,154 @@
+package server_test
+
+import (
+	"math"
+	"math/rand"
+	"server"
+	"testing"
+	"time"
+)
+
+func TestOperation(t *testing.T) {
+	t.Run("applies retains, inserts and deletes", func(t *testing.T) {
+		op := server.Operation{{Retain: 6}, {Delete: 5}, {Insert: "gophers"}, {Retain: 1}}
+		got, err := op.Apply("hello world!")
+		if err != nil {
+			t.Fatalf("unexpected error applying, %v", err)
+		}
+		if got != "hello gophers!" {
+			t.Errorf("got %q, want %q", got, "hello gophers!")
+		}
+	})
+
+	t.Run("counts characters rather than bytes", func(t *testing.T) {
+		op := server.Operation{{Retain: 1}, {Insert: "ü"}, {Delete: 1}}
+		got, err := op.Apply("✓✗")
+		if err != nil {
+			t.Fatalf("unexpected error applying, %v", err)
+		}
+		if got != "✓ü" {
+			t.Errorf("got %q, want %q", got, "✓ü")
+		}
+	})
+
+	t.Run("refuses operations that do not fit the document", func(t *testing.T) {
+		testcases := []struct {
+			name string
+			op   server.Operation
+		}{
+			{"too short", server.Operation{{Retain: 2}}},
+			{"too long", server.Operation{{Retain: 3}, {Delete: 1}}},
+			{"empty component", server.Operation{{Retain: 3}, {}}},
+			{"two kinds in one component", server.Operation{{Retain: 3, Insert: "x"}}},
+			{"negative length", server.Operation{{Retain: 4}, {Delete: -1}}},
+			{"lengths adding up past the largest int", server.Operation{{Retain: math.MaxInt64}, {Retain: math.MaxInt64}, {Retain: 5}}},
+			{"component longer than what is left", server.Operation{{Retain: 2}, {Delete: math.MaxInt64}, {Retain: math.MinInt64 + 2}}},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				if _, err := tc.op.Apply("abc"); err != server.InvalidOperationErr {
+					t.Errorf("got error %v, want %v", err, server.InvalidOperationErr)
+				}
+				if _, _, err := server.Transform(tc.op, server.Operation{{Retain: 3}}); err != server.InvalidOperationErr {
+					t.Errorf("got error %v transforming, want %v", err, server.InvalidOperationErr)
+				}
+			})
+		}
+	})
+
+	t.Run("puts the first operation's insert first when both insert at the same place", func(t *testing.T) {
+		a := server.Operation{{Retain: 1}, {Insert: "a"}, {Retain: 1}}
+		b := server.Operation{{Retain: 1}, {Insert: "b"}, {Retain: 1}}
+		aPrime, bPrime, err := server.Transform(a, b)
+		if err != nil {
+			t.Fatalf("unexpected error transforming, %v", err)
+		}
+		assertConverges(t, "xy", a, b, aPrime, bPrime)
+		if got := mustApply(t, mustApply(t, "xy", a), bPrime); got != "xaby" {
+			t.Errorf("got %q, want %q", got, "xaby")
+		}
+	})
+}
+
+func TestTransformAndCompose(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	for i := 0; i < 2000; i++ {
+		text := randomText(rng, rng.Intn(12))
+		a, b := randomOperation(rng, text), randomOperation(rng, text)
+
+		aPrime, bPrime, err := server.Transform(a, b)
+		if err != nil {
+			t.Fatalf("unexpected error transforming %v and %v, %v", a, b, err)
+		}
+		assertConverges(t, text, a, b, aPrime, bPrime)
+
+		edited := mustApply(t, text, a)
+		next := randomOperation(rng, edited)
+		composed, err := server.Compose(a, next)
+		if err != nil {
+			t.Fatalf("unexpected error composing %v and %v, %v", a, next, err)
+		}
+		if got, want := mustApply(t, text, composed), mustApply(t, edited, next); got != want {
+			t.Fatalf("composing %v and %v on %q gave %q, want %q", a, next, text, got, want)
+		}
+	}
+}
+
+func assertConverges(t testing.TB, text string, a, b, aPrime, bPrime server.Operation) {
+	t.Helper()
+	ab := mustApply(t, mustApply(t, text, a), bPrime)
+	ba := mustApply(t, mustApply(t, text, b), aPrime)
+	if ab != ba {
+		t.Fatalf("%v then %v gave %q, but %v then %v gave %q on %q", a, bPrime, ab, b, aPrime, ba, text)
+	}
+}
+
+func mustApply(t testing.TB, text string, op server.Operation) string {
+	t.Helper()
+	edited, err := op.Apply(text)
+	if err != nil {
+		t.Fatalf("unexpected error applying %v to %q, %v", op, text, err)
+	}
+	return edited
+}
+
+func randomText(rng *rand.Rand, n int) string {
+	alphabet := []rune("abc✓ü ")
+	text := make([]rune, n)
+	for i := range text {
+		text[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return string(text)
+}
+
+// randomOperation returns an operation on text made of a few random inserts and deletes.
+func randomOperation(rng *rand.Rand, text string) server.Operation {
+	var op server.Operation
+	left := len([]rune(text))
+	for left > 0 || rng.Intn(2) == 0 {
+		if left > 0 {
+			if n := rng.Intn(left + 1); n > 0 {
+				op = append(op, server.OpComponent{Retain: n})
+				left -= n
+			}
+		}
+		switch rng.Intn(3) {
+		case 0:
+			op = append(op, server.OpComponent{Insert: randomText(rng, 1+rng.Intn(3))})
+		case 1:
+			if left > 0 {
+				n := 1 + rng.Intn(left)
+				op = append(op, server.OpComponent{Delete: n})
+				left -= n
+			}
+		}
+		if left == 0 && rng.Intn(2) == 0 {
+			break
+		}
+	}
+	return op
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPairDocument is the document edited by clients of /pair, which name none.
+	DefaultPairDocument = "default"
+
+	// DefaultPairIdleTimeout is how long a document nobody is editing is kept in memory before it
+	// is evicted.
+	DefaultPairIdleTimeout = 10 * time.Minute
+
+	// DefaultPairHistorySize is how many of its latest operations a document keeps, to
+	// transform the operations of clients that have not seen them yet.
+	DefaultPairHistorySize = 1000
+
+	DocumentMessage  = "document"
+	OperationMessage = "operation"
+
+	defaultPairText = "hi, enter text here"
+)
+
+var (
+	InvalidRevisionErr = errors.New("Revision is ahead of the document, or too old to catch up from; open the document again.")
+	MissingRevisionErr = errors.New("The revision you are looking for does not exist.")
+)
+
+// DocumentPayload is sent to a client opening a document: its text as of revision, along with
+// the client's number in the document and where its other clients are.
+type DocumentPayload struct {
+	Revision int        `json:"revision"`
+	Text     string     `json:"text"`
+	Client   int        `json:"client,omitempty"`
+	Peers    []Presence `json:"peers,omitempty"`
+}
+
+// OperationPayload carries an operation along with a revision. A client sends the revision of
+// the document it edited; the server sends the revision the operation brought the document to,
+// and acks with just that revision.
+type OperationPayload struct {
+	Revision int       `json:"revision"`
+	Ops      Operation `json:"ops,omitempty"`
+}
+
+type revertPayload struct {
+	Revision *int `json:"revision"`
+}
+
+// pairDelivery is a frame for the socketUpdater worker to send to clients editing a document.
+type pairDelivery struct {
+	clients []*ClientWS
+	frame   interface{}
+}
+
+// pairDocument is a text edited together by the /pair clients that opened it. Clients send
+// operations against the revision they have, which are transformed against the operations
+// applied since, so that every client ends up with the same text.
+type pairDocument struct {
+	name string
+
+	mu         sync.Mutex
+	text       string
+	revision   int
+	history    []Operation // The operations that led to revision, oldest first.
+	clients    map[*ClientWS]*Presence
+	lastClient int       // The number given to the last client that joined.
+	idleSince  time.Time // When the last client left.
+}
+
+// edit transforms op, made against revision, over the operations applied since, and commits
+// it. It must be called with mu held.
+func (d *pairDocument) edit(ctx context.Context, store PairStore, revision int, op Operation, now time.Time) (PairRevision, error) {
+	base := d.revision - len(d.history)
+	if revision < base || revision > d.revision {
+		return PairRevision{}, InvalidRevisionErr
+	}
+
+	for _, concurrent := range d.history[revision-base:] {
+		var err error
+		if op, _, err = Transform(op, concurrent); err != nil {
+			return PairRevision{}, err
+		}
+	}
+	return d.commit(ctx, store, PairRevision{Ops: op, Time: now})
+}
+
+// commit applies the operation of r to the document as its next revision, once r is stored,
+// and returns r numbered. It must be called with mu held.
+func (d *pairDocument) commit(ctx context.Context, store PairStore, r PairRevision) (PairRevision, error) {
+	text, err := r.Ops.Apply(d.text)
+	if err != nil {
+		return PairRevision{}, err
+	}
+	r.Revision = d.revision + 1
+	if err := store.AppendRevision(ctx, d.name, r); err != nil {
+		return PairRevision{}, pairStoreFailure(err)
+	}
+
+	d.text = text
+	d.revision = r.Revision
+	d.remember(r.Ops)
+	for _, p := range d.clients {
+		p.rebase(r.Ops)
+	}
+	return r, nil
+}
+
+// remember adds op to the history, dropping the oldest operation once it holds
+// DefaultPairHistorySize.
+func (d *pairDocument) remember(op Operation) {
+	d.history = append(d.history, op)
+	if len(d.history) > DefaultPairHistorySize {
+		d.history = append([]Operation(nil), d.history[len(d.history)-DefaultPairHistorySize:]...)
+	}
+}
+
+// pairDocuments holds the open documents by name. Documents are loaded from the PairStore
+// when a client first opens them, and evicted once nobody has had them open for the idle
+// timeout; their revisions stay in the store.
+type pairDocuments struct {
+	mu   sync.Mutex // Taken before the mutex of a document.
+	docs map[string]*pairDocument
+}
+
+func newPairDocuments() *pairDocuments {
+	return &pairDocuments{docs: make(map[string]*pairDocument)}
+}
+
+// open returns document name, loading it from store when it is not open yet. It must be
+// called with mu held.
+func (p *pairDocuments) open(ctx context.Context, store PairStore, name string, now time.Time) (*pairDocument, error) {
+	if doc, ok := p.docs[name]; ok {
+		return doc, nil
+	}
+
+	revisions, err := store.GetRevisions(ctx, name)
+	if err != nil {
+		return nil, pairStoreFailure(err)
+	}
+	text, err := replayRevisions(revisions)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &pairDocument{name: name, text: text, revision: len(revisions), clients: make(map[*ClientWS]*Presence), idleSince: now}
+	for _, r := range revisions {
+		doc.remember(r.Ops)
+	}
+	p.docs[name] = doc
+	openPairDocuments.Add(1)
+	return doc, nil
+}
+
+// lock opens document name and returns it with its mu held.
+func (p *pairDocuments) lock(ctx context.Context, store PairStore, name string) (*pairDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	doc, err := p.open(ctx, store, name, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// Locked before p.mu is released, so that doc is not evicted while it is being edited.
+	doc.mu.Lock()
+	return doc, nil
+}
+
+// evictIdle drops the documents nobody has had open since before now minus timeout.
+func (p *pairDocuments) evictIdle(now time.Time, timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name, doc := range p.docs {
+		doc.mu.Lock()
+		idle := len(doc.clients) == 0 && now.Sub(doc.idleSince) >= timeout
+		doc.mu.Unlock()
+		if idle {
+			delete(p.docs, name)
+			openPairDocuments.Add(-1)
+			pairDocumentEvictions.Add(1)
+		}
+	}
+}
+
+// editPairDocument applies the operation in payload to doc, acks it to client with the new
+// revision and sends it to every other client of doc.
+func (s *Server) editPairDocument(doc *pairDocument, client *ClientWS, id string, payload json.RawMessage) error {
+	var edit OperationPayload
+	if err := decodePayload(payload, &edit); err != nil {
+		return err
+	}
+
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+
+	return s.whileOpen(func() error {
+		r, err := doc.edit(context.Background(), s.PairStore, edit.Revision, edit.Ops, time.Now())
+		if err != nil {
+			return err
+		}
+		return s.sendPairRevision(doc, client, id, r)
+	})
+}
+
+// revertPairDocument brings document name back to its text at revision, as a new revision
+// sent to every client of the document, and returns the document as reverted.
+func (s *Server) revertPairDocument(ctx context.Context, name string, revision int) (DocumentPayload, error) {
+	doc, err := s.pairs.lock(ctx, s.PairStore, name)
+	if err != nil {
+		return DocumentPayload{}, err
+	}
+	defer doc.mu.Unlock()
+
+	if revision < 0 || revision > doc.revision {
+		return DocumentPayload{}, MissingRevisionErr
+	}
+	revisions, err := s.pairRevisions(ctx, name)
+	if err != nil {
+		return DocumentPayload{}, err
+	}
+	text, err := replayRevisions(revisions[:revision])
+	if err != nil {
+		return DocumentPayload{}, err
+	}
+
+	err = s.whileOpen(func() error {
+		r, err := doc.commit(ctx, s.PairStore, PairRevision{Ops: diff(doc.text, text), Time: time.Now(), RevertedTo: &revision})
+		if err != nil {
+			return err
+		}
+		return s.sendPairRevision(doc, nil, "", r)
+	})
+	if err != nil {
+		return DocumentPayload{}, err
+	}
+	return DocumentPayload{Revision: doc.revision, Text: doc.text}, nil
+}
+
+// sendPairRevision acks r to client, which made it, with id and sends it to every other client
+// of doc. client is nil for revisions no client made. It must be called with doc.mu held, so
+// that every client receives the operations in revision order, and from whileOpen along with
+// the commit of r, so that a revision stored is always sent.
+func (s *Server) sendPairRevision(doc *pairDocument, client *ClientWS, id string, r PairRevision) error {
+	ack, err := json.Marshal(OperationPayload{Revision: r.Revision})
+	if err != nil {
+		return err
+	}
+	applied, err := json.Marshal(OperationPayload{Revision: r.Revision, Ops: r.Ops})
+	if err != nil {
+		return err
+	}
+	if client != nil {
+		s.sendChannel <- pairDelivery{clients: []*ClientWS{client}, frame: Envelope{Type: AckMessage, ID: id, Payload: ack}}
+	}
+	if others := doc.others(client); len(others) > 0 {
+		s.sendChannel <- pairDelivery{clients: others, frame: Envelope{Type: OperationMessage, Payload: applied}}
+	}
+	return nil
+}
+
+// pairRevisions returns the revision log of document name.
+func (s *Server) pairRevisions(ctx context.Context, name string) ([]PairRevision, error) {
+	revisions, err := s.PairStore.GetRevisions(ctx, name)
+	if err != nil {
+		return nil, pairStoreFailure(err)
+	}
+	return revisions, nil
+}
+
+// pairText returns document name as of revision.
+func (s *Server) pairText(ctx context.Context, name string, revision int) (DocumentPayload, error) {
+	revisions, err := s.pairRevisions(ctx, name)
+	if err != nil {
+		return DocumentPayload{}, err
+	}
+	if revision < 0 || revision > len(revisions) {
+		return DocumentPayload{}, MissingRevisionErr
+	}
+	text, err := replayRevisions(revisions[:revision])
+	if err != nil {
+		return DocumentPayload{}, err
+	}
+	return DocumentPayload{Revision: revision, Text: text}, nil
+}
+
+// replyPairError sends client an error for its message id.
+func (s *Server) replyPairError(client *ClientWS, id string, e MessageError) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Unable to encode %s payload, %v", ErrorMessage, err)
+		return
+	}
+	if err := s.queuePairDelivery(pairDelivery{clients: []*ClientWS{client}, frame: Envelope{Type: ErrorMessage, ID: id, Payload: payload}}); err != nil {
+		log.Printf("Dropped pair error reply, %v", err)
+	}
+}
+
+// dispatchPair handles one frame sent by a client of doc.
+func (s *Server) dispatchPair(doc *pairDocument, client *ClientWS, frame []byte) {
+	var env Envelope
+	err := json.Unmarshal(frame, &env)
+	if err != nil {
+		s.replyPairError(client, "", NewMessageError(payloadError{err}))
+		return
+	}
+
+	switch env.Type {
+	case OperationMessage:
+		err = s.editPairDocument(doc, client, env.ID, env.Payload)
+	case CursorMessage:
+		err = s.movePairCursor(doc, client, env.Payload)
+	default:
+		s.replyPairError(client, env.ID, MessageError{Code: UnknownTypeCode, Message: fmt.Sprintf("unknown message type %q", env.Type)})
+		return
+	}
+	if err != nil {
+		s.replyPairError(client, env.ID, NewMessageError(err))
+	}
+}
+
+// isPairPath reports whether path is served by pairHandler.
+func isPairPath(path string) bool {
+	return path == "/pair" || strings.HasPrefix(path, "/pair/")
+}
+
+// getPairPathFromRequest reads the document of /pair/{doc}, which is DefaultPairDocument for
+// /pair, and what follows it in the path: "history", "history/{revision}" or "revert".
+func getPairPathFromRequest(r *http.Request) (name, action string, err error) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/pair"), "/")
+	if path == "" {
+		return DefaultPairDocument, "", nil
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if !validName(parts[0]) {
+		return "", "", InvalidDocumentErr
+	}
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	return parts[0], action, nil
+}
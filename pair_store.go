@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const pairLogExtension = ".log"
+
+// PairRevision is an entry of the revision log of a pair document: the operation that took it
+// from the previous revision to Revision. Revisions start from 1, revision 0 being the text
+// every document starts with. RevertedTo is set on the revisions that reverted the document.
+type PairRevision struct {
+	Revision   int       `json:"revision"`
+	Ops        Operation `json:"ops"`
+	Time       time.Time `json:"time"`
+	RevertedTo *int      `json:"reverted_to,omitempty"`
+}
+
+// PairStore keeps the revision logs of pair documents, by document name. GetRevisions returns
+// every revision of a document, oldest first, and none for a document never edited.
+// AppendRevision is called with the revisions of a document in order, one at a time, and
+// returns once the revision is stored.
+type PairStore interface {
+	GetRevisions(ctx context.Context, doc string) ([]PairRevision, error)
+	AppendRevision(ctx context.Context, doc string, revision PairRevision) error
+}
+
+// MemPairStore keeps revision logs in memory, so they last as long as the process. The zero
+// value is ready to use.
+type MemPairStore struct {
+	mu   sync.RWMutex
+	logs map[string][]PairRevision
+}
+
+func (s *MemPairStore) GetRevisions(ctx context.Context, doc string) ([]PairRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]PairRevision(nil), s.logs[doc]...), nil
+}
+
+func (s *MemPairStore) AppendRevision(ctx context.Context, doc string, revision PairRevision) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logs == nil {
+		s.logs = make(map[string][]PairRevision)
+	}
+	s.logs[doc] = append(s.logs[doc], revision)
+	return nil
+}
+
+// FilePairStore keeps the revision log of each document in its own file in a directory,
+// {doc}.log, with one JSON revision per line. Document names are valid file names, see
+// validName.
+type FilePairStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewFilePairStore opens the store in dir, creating it when missing.
+func NewFilePairStore(dir string) (*FilePairStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("Error creating %s directory, %v", dir, err)
+	}
+	return &FilePairStore{dir: dir}, nil
+}
+
+func (s *FilePairStore) path(doc string) string {
+	return filepath.Join(s.dir, doc+pairLogExtension)
+}
+
+// GetRevisions reads the log of doc. A final revision without its newline was cut short by a
+// crash before it was synced, so it is dropped rather than treated as corruption.
+func (s *FilePairStore) GetRevisions(ctx context.Context, doc string) ([]PairRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path(doc), os.O_RDWR, 0666)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %s file, %v", s.path(doc), err)
+	}
+	defer file.Close()
+
+	var revisions []PairRevision
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) == 0 {
+				return revisions, nil
+			}
+			log.Printf("Dropping incomplete revision at byte %d of %s.", offset, file.Name())
+			return revisions, file.Truncate(offset)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("problem reading %s, %v", file.Name(), err)
+		}
+
+		var r PairRevision
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, fmt.Errorf("corrupt revision at byte %d of %s, %v", offset, file.Name(), err)
+		}
+		revisions = append(revisions, r)
+		offset += int64(len(line))
+	}
+}
+
+func (s *FilePairStore) AppendRevision(ctx context.Context, doc string, revision PairRevision) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	line, err := json.Marshal(revision)
+	if err != nil {
+		return fmt.Errorf("problem encoding revision %d of %s, %v", revision.Revision, doc, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(s.path(doc), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("Error opening %s file, %v", s.path(doc), err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("problem reading %s, %v", file.Name(), err)
+	}
+
+	// A revision that failed to be written or synced is cut off again, so that the revision
+	// retried in its place is not logged after it.
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Truncate(info.Size())
+		return fmt.Errorf("problem writing to %s, %v", file.Name(), err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Truncate(info.Size())
+		return fmt.Errorf("problem syncing %s, %v", file.Name(), err)
+	}
+	if revision.Revision == 1 {
+		// The log was just created; make its directory entry durable too.
+		return syncDir(s.dir)
+	}
+	return nil
+}
+
+// pairStoreFailure wraps err from a PairStore in a StoreError, unless it is the end of the
+// request's context.
+func pairStoreFailure(err error) error {
+	if contextEnded(err) {
+		return err
+	}
+	log.Printf("Pair store failed, %v", err)
+	return StoreError{Err: err}
+}
+
+// replayRevisions returns the text of a document after revisions, which must be numbered from
+// 1 with none missing or repeated. A log that does not replay is a failure of the store.
+func replayRevisions(revisions []PairRevision) (string, error) {
+	text := defaultPairText
+	for i, r := range revisions {
+		if r.Revision != i+1 {
+			log.Printf("Pair store failed, found revision %d where revision %d belongs", r.Revision, i+1)
+			return "", StoreError{Err: fmt.Errorf("revision %d is out of order", r.Revision)}
+		}
+		var err error
+		if text, err = r.Ops.Apply(text); err != nil {
+			log.Printf("Pair store failed, revision %d does not apply, %v", r.Revision, err)
+			return "", StoreError{Err: err}
+		}
+	}
+	return text, nil
+}
@@ -0,0 +1,102 @@
+package server_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"server"
+	"testing"
+	"time"
+)
+
+func TestFilePairStore(t *testing.T) {
+	revisions := []server.PairRevision{
+		{Revision: 1, Ops: server.Operation{{Insert: "a"}, {Delete: 19}}, Time: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Revision: 2, Ops: server.Operation{{Retain: 1}, {Insert: "b"}}, Time: time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)},
+	}
+
+	t.Run("reads revisions back after a restart", func(t *testing.T) {
+		dir, clean := createTempPairDir(t)
+		defer clean()
+
+		store := openFilePairStore(t, dir)
+		for _, r := range revisions {
+			if err := store.AppendRevision(context.Background(), "notes", r); err != nil {
+				t.Fatalf("unexpected error appending, %v", err)
+			}
+		}
+
+		assertRevisions(t, getRevisions(t, openFilePairStore(t, dir), "notes"), revisions)
+		assertRevisions(t, getRevisions(t, openFilePairStore(t, dir), "plans"), nil)
+	})
+
+	t.Run("drops a revision cut short by a crash", func(t *testing.T) {
+		dir, clean := createTempPairDir(t)
+		defer clean()
+
+		store := openFilePairStore(t, dir)
+		store.AppendRevision(context.Background(), "notes", revisions[0])
+		log, err := os.OpenFile(filepath.Join(dir, "notes.log"), os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			t.Fatalf("could not open log, %v", err)
+		}
+		log.WriteString(`{"revision":2,"ops":[{"ret`)
+		log.Close()
+
+		reopened := openFilePairStore(t, dir)
+		assertRevisions(t, getRevisions(t, reopened, "notes"), revisions[:1])
+
+		reopened.AppendRevision(context.Background(), "notes", revisions[1])
+		assertRevisions(t, getRevisions(t, openFilePairStore(t, dir), "notes"), revisions)
+	})
+
+	t.Run("refuses a corrupt revision", func(t *testing.T) {
+		dir, clean := createTempPairDir(t)
+		defer clean()
+
+		ioutil.WriteFile(filepath.Join(dir, "notes.log"), []byte("not json\n"), 0666)
+
+		if _, err := openFilePairStore(t, dir).GetRevisions(context.Background(), "notes"); err == nil {
+			t.Error("wanted an error reading a corrupt log")
+		}
+	})
+}
+
+func createTempPairDir(t testing.TB) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pairs")
+	if err != nil {
+		t.Fatalf("could not create temp dir %v", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func openFilePairStore(t testing.TB, dir string) *server.FilePairStore {
+	t.Helper()
+	store, err := server.NewFilePairStore(dir)
+	if err != nil {
+		t.Fatalf("Unable to make new pair store, %v", err)
+	}
+	return store
+}
+
+func getRevisions(t testing.TB, store server.PairStore, doc string) []server.PairRevision {
+	t.Helper()
+	revisions, err := store.GetRevisions(context.Background(), doc)
+	if err != nil {
+		t.Fatalf("unexpected error getting revisions, %v", err)
+	}
+	return revisions
+}
+
+func assertRevisions(t testing.TB, got, want []server.PairRevision) {
+	t.Helper()
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got revisions %v, want %v", got, want)
+	}
+}
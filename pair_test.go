@@ -1,19 +1,29 @@
 package server_test
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"server"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
+const welcomeText = "hi, enter text here"
+
 func TestPairWS(t *testing.T) {
 	testStore := &spyStore{}
 
-	threadServer := server.NewServer(testStore, NewSpyClientManager())
+	threadServer := server.NewServer(server.AdaptThreadStore(testStore), NewSpyClientManager())
 	go threadServer.StartWorkers()
 
 	testServer := httptest.NewServer(threadServer)
@@ -22,35 +32,694 @@ func TestPairWS(t *testing.T) {
 
 	defer ws.Close()
 	defer testServer.Close()
-	t.Run("Receives default value", func(t *testing.T) {
-		welcomeMessage := []byte("hi, enter text here")
-		_, msg, err := ws.ReadMessage()
+	t.Run("Receives default document", func(t *testing.T) {
+		assertDocument(t, readDocument(t, ws), 0, welcomeText)
+	})
+
+	t.Run("Edits the document with operations", func(t *testing.T) {
+		sendMessage(t, ws, server.OperationMessage, "1", server.OperationPayload{Revision: 0, Ops: replaceText(welcomeText, "this is a sample message")})
+		ack := readEnvelope(t, ws)
+		assertEnvelope(t, ack, server.AckMessage, "1")
+		assertRevision(t, readOperation(t, ack), 1)
+
+		edit := server.Operation{{Retain: 24}, {Insert: "\nanother message behind."}}
+		sendMessage(t, ws, server.OperationMessage, "2", server.OperationPayload{Revision: 1, Ops: edit})
+		assertRevision(t, readOperation(t, readEnvelope(t, ws)), 2)
+
+		latecomer := MustDialWS(t, wsURL)
+		assertDocument(t, readDocument(t, latecomer), 2, "this is a sample message\nanother message behind.")
+		assertPresenceEvent(t, readEnvelope(t, ws), server.JoinPresence, 2)
+		latecomer.Close()
+		assertPresenceEvent(t, readEnvelope(t, ws), server.LeavePresence, 2)
+	})
+
+	t.Run("Refuses edits that cannot be applied", func(t *testing.T) {
+		testcases := []struct {
+			name    string
+			payload server.OperationPayload
+			code    string
+		}{
+			{"operation of the wrong length", server.OperationPayload{Revision: 2, Ops: server.Operation{{Retain: 3}}}, server.InvalidOperationCode},
+			{"revision ahead of the document", server.OperationPayload{Revision: 3, Ops: server.Operation{{Retain: 49}}}, server.InvalidRevisionCode},
+			{"negative revision", server.OperationPayload{Revision: -1, Ops: server.Operation{{Retain: 49}}}, server.InvalidRevisionCode},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				sendMessage(t, ws, server.OperationMessage, "bad", tc.payload)
+				got := readEnvelope(t, ws)
+				assertEnvelope(t, got, server.ErrorMessage, "bad")
+				assertMessageError(t, got, tc.code, "")
+			})
+		}
+
+		sendMessage(t, ws, "subscribe", "3", nil)
+		got := readEnvelope(t, ws)
+		assertEnvelope(t, got, server.ErrorMessage, "3")
+		assertMessageError(t, got, server.UnknownTypeCode, "")
+	})
+}
+
+func TestPairDocuments(t *testing.T) {
+	pairStore := &countingPairStore{loads: make(map[string]int)}
+	threadServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+	threadServer.PairIdleTimeout = 50 * time.Millisecond
+	threadServer.PairStore = pairStore
+	go threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/pair/"
+
+	dial := func(t *testing.T, doc string) *websocket.Conn {
+		t.Helper()
+		ws := MustDialWS(t, wsURL+doc)
+		assertDocument(t, readDocument(t, ws), 0, welcomeText)
+		return ws
+	}
+
+	t.Run("documents are edited independently", func(t *testing.T) {
+		alice, bob, carol := dial(t, "notes"), dial(t, "notes"), dial(t, "plans")
+		defer alice.Close()
+		defer bob.Close()
+		defer carol.Close()
+		assertPresenceEvent(t, readEnvelope(t, alice), server.JoinPresence, 2)
+
+		notes, plans := replaceText(welcomeText, "meeting at noon"), replaceText(welcomeText, "ship it")
+		sendMessage(t, alice, server.OperationMessage, "", server.OperationPayload{Ops: notes})
+		sendMessage(t, carol, server.OperationMessage, "", server.OperationPayload{Ops: plans})
+
+		assertEnvelope(t, readEnvelope(t, alice), server.AckMessage, "")
+		got := readEnvelope(t, bob)
+		assertEnvelope(t, got, server.OperationMessage, "")
+		assertRevision(t, readOperation(t, got), 1)
+		if text := mustApply(t, welcomeText, readOperation(t, got).Ops); text != "meeting at noon" {
+			t.Errorf("got %q, want %q", text, "meeting at noon")
+		}
+		assertEnvelope(t, readEnvelope(t, carol), server.AckMessage, "")
+	})
+
+	t.Run("documents nobody edits are evicted, and loaded again from the store", func(t *testing.T) {
+		ws := dial(t, "scratch")
+		sendMessage(t, ws, server.OperationMessage, "", server.OperationPayload{Ops: replaceText(welcomeText, "draft")})
+		readEnvelope(t, ws)
+		ws.Close()
+
+		// Every probe opens the document again, so wait long enough for it to go idle in between.
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			time.Sleep(4 * threadServer.PairIdleTimeout)
+			reopened := MustDialWS(t, wsURL+"scratch")
+			doc := readDocument(t, reopened)
+			reopened.Close()
+			assertDocument(t, doc, 1, "draft")
+			if pairStore.loaded("scratch") > 1 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("document was not evicted after its clients left")
+			}
+		}
+	})
+
+	t.Run("invalid document names are refused", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newGETRequest("/pair/My%20Doc"))
+		assertStatus(t, response, http.StatusBadRequest)
+	})
+}
+
+func TestPairIdleTimeouts(t *testing.T) {
+	for _, timeout := range []time.Duration{0, -time.Second, time.Nanosecond} {
+		t.Run(timeout.String(), func(t *testing.T) {
+			threadServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+			threadServer.PairIdleTimeout = timeout
+			threadServer.StartWorkers()
+			defer threadServer.Shutdown(context.Background())
+
+			testServer := httptest.NewServer(threadServer)
+			defer testServer.Close()
+			ws := MustDialWS(t, "ws"+strings.TrimPrefix(testServer.URL, "http")+"/pair/notes")
+			defer ws.Close()
+			assertDocument(t, readDocument(t, ws), 0, welcomeText)
+			time.Sleep(10 * time.Millisecond)
+		})
+	}
+}
+
+func TestPairHistory(t *testing.T) {
+	threadServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+	go threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	defer testServer.Close()
+	ws := MustDialWS(t, "ws"+strings.TrimPrefix(testServer.URL, "http")+"/pair/notes")
+	defer ws.Close()
+	readDocument(t, ws)
+
+	texts := []string{welcomeText, "first", "first draft", "final draft"}
+	for i := 1; i < len(texts); i++ {
+		sendMessage(t, ws, server.OperationMessage, "", server.OperationPayload{Revision: i - 1, Ops: replaceText(texts[i-1], texts[i])})
+		assertRevision(t, readOperation(t, readEnvelope(t, ws)), i)
+	}
+
+	t.Run("lists the revisions of a document", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newGETRequest("/pair/notes/history"))
+		assertStatus(t, response, http.StatusOK)
+
+		var revisions []server.PairRevision
+		if err := json.NewDecoder(response.Body).Decode(&revisions); err != nil {
+			t.Fatalf("could not decode revisions, %v", err)
+		}
+		if len(revisions) != 3 {
+			t.Fatalf("got %d revisions, want 3", len(revisions))
+		}
+		text := welcomeText
+		for i, r := range revisions {
+			if r.Revision != i+1 || r.Time.IsZero() {
+				t.Errorf("got revision %d at %v, want revision %d with its time", r.Revision, r.Time, i+1)
+			}
+			text = mustApply(t, text, r.Ops)
+		}
+		if text != "final draft" {
+			t.Errorf("revisions give %q, want %q", text, "final draft")
+		}
+	})
+
+	t.Run("a document never edited has no revisions", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newGETRequest("/pair/blank/history"))
+		assertStatus(t, response, http.StatusOK)
+		assertBodyString(t, response, "[]\n")
+	})
+
+	t.Run("serves the text at every revision", func(t *testing.T) {
+		for i, want := range texts {
+			response := httptest.NewRecorder()
+			threadServer.ServeHTTP(response, newGETRequest(fmt.Sprintf("/pair/notes/history/%d", i)))
+			assertStatus(t, response, http.StatusOK)
+			assertDocument(t, getDocumentFromBody(t, response), i, want)
+		}
+	})
+
+	t.Run("reverts to an earlier revision and sends it to editors", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newPOSTRequest("/pair/notes/revert", map[string]int{"revision": 1}))
+		assertStatus(t, response, http.StatusOK)
+		assertDocument(t, getDocumentFromBody(t, response), 4, "first")
+
+		got := readEnvelope(t, ws)
+		assertEnvelope(t, got, server.OperationMessage, "")
+		op := readOperation(t, got)
+		assertRevision(t, op, 4)
+		if text := mustApply(t, "final draft", op.Ops); text != "first" {
+			t.Errorf("editor got %q, want %q", text, "first")
+		}
+
+		response = httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newGETRequest("/pair/notes/history/3"))
+		assertDocument(t, getDocumentFromBody(t, response), 3, "final draft")
+	})
+
+	t.Run("refuses revisions that do not exist", func(t *testing.T) {
+		testcases := []struct {
+			name    string
+			request *http.Request
+			status  int
+		}{
+			{"text after the last revision", newGETRequest("/pair/notes/history/5"), http.StatusNotFound},
+			{"text before the first revision", newGETRequest("/pair/notes/history/-1"), http.StatusNotFound},
+			{"revision that is not a number", newGETRequest("/pair/notes/history/latest"), http.StatusNotFound},
+			{"revert after the last revision", newPOSTRequest("/pair/notes/revert", map[string]int{"revision": 5}), http.StatusNotFound},
+			{"revert without a revision", newPOSTRequest("/pair/notes/revert", map[string]int{}), http.StatusBadRequest},
+			{"unknown action", newGETRequest("/pair/notes/future"), http.StatusNotFound},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				response := httptest.NewRecorder()
+				threadServer.ServeHTTP(response, tc.request)
+				assertStatus(t, response, tc.status)
+			})
+		}
+	})
+
+	t.Run("refuses a log with a revision missing", func(t *testing.T) {
+		threadServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+		for _, r := range []server.PairRevision{
+			{Revision: 1, Ops: replaceText(welcomeText, "first")},
+			{Revision: 3, Ops: replaceText("first", "third")},
+		} {
+			threadServer.PairStore.AppendRevision(context.Background(), "gaps", r)
+		}
+
+		for _, request := range []*http.Request{
+			newGETRequest("/pair/gaps/history/2"),
+			newPOSTRequest("/pair/gaps/revert", map[string]int{"revision": 1}),
+		} {
+			response := httptest.NewRecorder()
+			threadServer.ServeHTTP(response, request)
+			assertStatus(t, response, http.StatusInternalServerError)
+		}
+	})
+
+	t.Run("keeps documents across restarts", func(t *testing.T) {
+		dir, clean := createTempPairDir(t)
+		defer clean()
+
+		wsURL := func(s *httptest.Server) string {
+			return "ws" + strings.TrimPrefix(s.URL, "http") + "/pair/notes"
+		}
+		start := func() *httptest.Server {
+			threadServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+			threadServer.PairStore = openFilePairStore(t, dir)
+			go threadServer.StartWorkers()
+			return httptest.NewServer(threadServer)
+		}
+
+		before := start()
+		ws := MustDialWS(t, wsURL(before))
+		readDocument(t, ws)
+		sendMessage(t, ws, server.OperationMessage, "", server.OperationPayload{Ops: replaceText(welcomeText, "kept")})
+		readEnvelope(t, ws)
+		ws.Close()
+		before.Close()
+
+		after := start()
+		defer after.Close()
+		reopened := MustDialWS(t, wsURL(after))
+		defer reopened.Close()
+		assertDocument(t, readDocument(t, reopened), 1, "kept")
+	})
+}
+
+func TestPairShutdown(t *testing.T) {
+	threadServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+	threadServer.StartWorkers()
+	threadServer.PairStore.AppendRevision(context.Background(), "notes", server.PairRevision{Revision: 1, Ops: replaceText(welcomeText, "first")})
+
+	if err := threadServer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("could not shut down, %v", err)
+	}
+
+	response := httptest.NewRecorder()
+	threadServer.ServeHTTP(response, newPOSTRequest("/pair/notes/revert", map[string]int{"revision": 0}))
+	assertStatus(t, response, http.StatusServiceUnavailable)
+
+	response = httptest.NewRecorder()
+	threadServer.ServeHTTP(response, newGETRequest("/pair/notes/history"))
+	assertStatus(t, response, http.StatusOK)
+	var revisions []server.PairRevision
+	if err := json.NewDecoder(response.Body).Decode(&revisions); err != nil {
+		t.Fatalf("could not decode revisions, %v", err)
+	}
+	if len(revisions) != 1 {
+		t.Errorf("got %d revisions after shutdown, want the 1 stored before", len(revisions))
+	}
+}
+
+func TestPairConvergence(t *testing.T) {
+	threadServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+	go threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/pair/race"
+
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+
+	const clients, edits = 4, 40
+	editors := make([]*pairEditor, clients)
+	for i := range editors {
+		editors[i] = newPairEditor(t, MustDialWS(t, wsURL), rand.New(rand.NewSource(seed+int64(i))))
+		defer editors[i].ws.Close()
+	}
 
+	// Every editor makes its edits while receiving the others', then waits for its own to be acked.
+	errs := make(chan error, clients)
+	var wg sync.WaitGroup
+	for _, e := range editors {
+		wg.Add(1)
+		go func(e *pairEditor) {
+			defer wg.Done()
+			errs <- e.edit(edits)
+		}(e)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
 		if err != nil {
-			t.Errorf("Error reading message, %v", err)
+			t.Fatal(err)
+		}
+	}
+
+	observer := MustDialWS(t, wsURL)
+	defer observer.Close()
+	// Edits made while waiting for an ack are sent as one operation, so there are fewer
+	// revisions than edits.
+	want := readDocument(t, observer)
+
+	for i, e := range editors {
+		if err := e.catchUp(want.Revision); err != nil {
+			t.Fatal(err)
+		}
+		if e.text != want.Text {
+			t.Errorf("editor %d holds %q, the document holds %q", i, e.text, want.Text)
+		}
+	}
+
+	// Cursors are rebased over every edit made after they were sent.
+	length := utf8.RuneCountInString(want.Text)
+	for _, p := range want.Peers {
+		if p.Revision != want.Revision || p.Cursor > length || p.Selections != nil && (p.Selections[0].Anchor > length || p.Selections[0].Head > length) {
+			t.Errorf("client %d is at %+v, outside the document of length %d at revision %d", p.Client, p, length, want.Revision)
+		}
+	}
+}
+
+func TestPairPresence(t *testing.T) {
+	threadServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+	go threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/pair/notes?user="
+
+	alice := MustDialWS(t, wsURL+"alice")
+	defer alice.Close()
+	if doc := readDocument(t, alice); doc.Client != 1 || len(doc.Peers) != 0 {
+		t.Fatalf("got client %d with peers %v, want client 1 alone", doc.Client, doc.Peers)
+	}
+
+	bob := MustDialWS(t, wsURL+"bob")
+	defer bob.Close()
+
+	t.Run("clients learn who else is in the document", func(t *testing.T) {
+		doc := readDocument(t, bob)
+		want := []server.Presence{{Client: 1, User: "alice"}}
+		if doc.Client != 2 || !reflect.DeepEqual(doc.Peers, want) {
+			t.Errorf("got client %d with peers %v, want client 2 with %v", doc.Client, doc.Peers, want)
 		}
 
-		assertRightMessage(t, welcomeMessage, msg)
+		joined := readPresence(t, readEnvelope(t, alice), server.PresenceMessage)
+		if joined.Event != server.JoinPresence || joined.Client != 2 || joined.User != "bob" {
+			t.Errorf("got %+v, want bob joining as client 2", joined)
+		}
+	})
+
+	t.Run("cursors are sent to the other clients", func(t *testing.T) {
+		sendMessage(t, alice, server.CursorMessage, "", server.Presence{Cursor: 5, Selections: []server.Selection{{Anchor: 3, Head: 7}}})
+
+		got := readPresence(t, readEnvelope(t, bob), server.CursorMessage)
+		want := server.PresenceEvent{Presence: server.Presence{Client: 1, User: "alice", Cursor: 5, Selections: []server.Selection{{Anchor: 3, Head: 7}}}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
 	})
 
-	t.Run("Changes value with new messages sent", func(t *testing.T) {
-		firstMessage := []byte("this is a sample message")
-		ws.WriteMessage(websocket.TextMessage, firstMessage)
+	t.Run("cursors are rebased over concurrent edits", func(t *testing.T) {
+		sendMessage(t, bob, server.OperationMessage, "", server.OperationPayload{Ops: server.Operation{{Insert: "oh "}, {Retain: 19}}})
+		assertEnvelope(t, readEnvelope(t, bob), server.AckMessage, "")
+		assertEnvelope(t, readEnvelope(t, alice), server.OperationMessage, "")
+
+		// alice moved before seeing bob's edit.
+		sendMessage(t, alice, server.CursorMessage, "", server.Presence{Revision: 0, Cursor: 2, Selections: []server.Selection{{Anchor: 19, Head: 0}}})
+		got := readPresence(t, readEnvelope(t, bob), server.CursorMessage)
+		want := server.Presence{Client: 1, User: "alice", Revision: 1, Cursor: 5, Selections: []server.Selection{{Anchor: 22, Head: 3}}}
+		if !reflect.DeepEqual(got.Presence, want) {
+			t.Errorf("got %+v, want %+v", got.Presence, want)
+		}
 
-		_, msg, _ := ws.ReadMessage()
-		assertRightMessage(t, firstMessage, msg)
+		carol := MustDialWS(t, wsURL+"carol")
+		defer carol.Close()
+		peers := []server.Presence{want, {Client: 2, User: "bob", Revision: 1, Cursor: 3}}
+		if doc := readDocument(t, carol); !reflect.DeepEqual(doc.Peers, peers) {
+			t.Errorf("got peers %+v, want %+v", doc.Peers, peers)
+		}
+		readEnvelope(t, alice)
+		readEnvelope(t, bob)
 
-		secondMessage := append(firstMessage, []byte("/n another message behind.")...)
-		ws.WriteMessage(websocket.TextMessage, secondMessage)
+		testcases := []struct {
+			name   string
+			cursor server.Presence
+			code   string
+		}{
+			{"cursor past the end", server.Presence{Revision: 1, Cursor: 23}, server.InvalidPositionCode},
+			{"selection before the start", server.Presence{Revision: 1, Selections: []server.Selection{{Anchor: -1}}}, server.InvalidPositionCode},
+			{"revision ahead of the document", server.Presence{Revision: 2}, server.InvalidRevisionCode},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				sendMessage(t, carol, server.CursorMessage, "bad", tc.cursor)
+				got := readEnvelope(t, carol)
+				assertEnvelope(t, got, server.ErrorMessage, "bad")
+				assertMessageError(t, got, tc.code, "")
+			})
+		}
+	})
 
-		_, msg, _ = ws.ReadMessage()
-		assertRightMessage(t, secondMessage, msg)
+	t.Run("clients learn who left", func(t *testing.T) {
+		assertPresenceEvent(t, readEnvelope(t, alice), server.LeavePresence, 3)
+		bob.Close()
+		left := readPresence(t, readEnvelope(t, alice), server.PresenceMessage)
+		if left.Event != server.LeavePresence || left.Client != 2 || left.User != "bob" {
+			t.Errorf("got %+v, want bob leaving as client 2", left)
+		}
 	})
+}
+
+// pairEditor edits a pair document the way a client does: it sends one operation at a time,
+// buffers its edits until the operation is acked, and transforms the operations of others
+// over the ones not acked yet.
+type pairEditor struct {
+	ws       *websocket.Conn
+	rng      *rand.Rand
+	incoming chan server.Envelope
+
+	text        string
+	revision    int
+	outstanding server.Operation
+	buffer      server.Operation
+	sent        bool // An operation is waiting to be acked.
+	buffered    bool
+}
+
+func newPairEditor(t testing.TB, ws *websocket.Conn, rng *rand.Rand) *pairEditor {
+	doc := readDocument(t, ws)
+	e := &pairEditor{ws: ws, rng: rng, incoming: make(chan server.Envelope, 64), text: doc.Text, revision: doc.Revision}
+	go func() {
+		defer close(e.incoming)
+		for {
+			var env server.Envelope
+			ws.SetReadDeadline(time.Time{})
+			if err := ws.ReadJSON(&env); err != nil {
+				return
+			}
+			e.incoming <- env
+		}
+	}()
+	return e
+}
+
+func (e *pairEditor) edit(edits int) error {
+	for made := 0; made < edits || e.sent; {
+		// Positions are only known at a revision when no edit is waiting to be acked.
+		if !e.sent && e.rng.Intn(4) == 0 {
+			if err := e.moveCursor(); err != nil {
+				return err
+			}
+		}
+		if made < edits && e.rng.Intn(3) == 0 {
+			if err := e.local(randomOperation(e.rng, e.text)); err != nil {
+				return err
+			}
+			made++
+			continue
+		}
+		select {
+		case env, ok := <-e.incoming:
+			if err := e.receive(env, ok); err != nil {
+				return err
+			}
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return nil
+}
 
+// catchUp receives operations until the editor has the document at revision.
+func (e *pairEditor) catchUp(revision int) error {
+	for e.revision < revision {
+		select {
+		case env, ok := <-e.incoming:
+			if err := e.receive(env, ok); err != nil {
+				return err
+			}
+		case <-time.After(2 * time.Second):
+			return fmt.Errorf("editor is stuck at revision %d, want %d", e.revision, revision)
+		}
+	}
+	return nil
+}
+
+func (e *pairEditor) local(op server.Operation) (err error) {
+	if e.text, err = op.Apply(e.text); err != nil {
+		return err
+	}
+	switch {
+	case !e.sent:
+		e.outstanding, e.sent = op, true
+		return e.send(op)
+	case !e.buffered:
+		e.buffer, e.buffered = op, true
+	default:
+		e.buffer, err = server.Compose(e.buffer, op)
+	}
+	return err
+}
+
+func (e *pairEditor) moveCursor() error {
+	length := utf8.RuneCountInString(e.text)
+	anchor, head := e.rng.Intn(length+1), e.rng.Intn(length+1)
+	cursor := server.Presence{Revision: e.revision, Cursor: head, Selections: []server.Selection{{Anchor: anchor, Head: head}}}
+	return e.ws.WriteJSON(server.Envelope{Type: server.CursorMessage, Payload: mustMarshal(cursor)})
+}
+
+func (e *pairEditor) send(op server.Operation) error {
+	return e.ws.WriteJSON(server.Envelope{Type: server.OperationMessage, Payload: mustMarshal(server.OperationPayload{Revision: e.revision, Ops: op})})
+}
+
+func (e *pairEditor) receive(env server.Envelope, ok bool) (err error) {
+	if !ok {
+		return fmt.Errorf("connection closed at revision %d", e.revision)
+	}
+	var payload server.OperationPayload
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		return err
+	}
+
+	switch env.Type {
+	case server.AckMessage:
+		e.revision = payload.Revision
+		e.sent = false
+		if e.buffered {
+			e.outstanding, e.sent, e.buffered = e.buffer, true, false
+			return e.send(e.outstanding)
+		}
+		return nil
+	case server.PresenceMessage, server.CursorMessage:
+		return nil
+	case server.OperationMessage:
+		op := payload.Ops
+		if e.sent {
+			if e.outstanding, op, err = server.Transform(e.outstanding, op); err != nil {
+				return err
+			}
+		}
+		if e.buffered {
+			if e.buffer, op, err = server.Transform(e.buffer, op); err != nil {
+				return err
+			}
+		}
+		e.revision = payload.Revision
+		e.text, err = op.Apply(e.text)
+		return err
+	}
+	return fmt.Errorf("unexpected %s message %s", env.Type, env.Payload)
+}
+
+// countingPairStore counts how often each document is loaded.
+type countingPairStore struct {
+	server.MemPairStore
+	mu    sync.Mutex
+	loads map[string]int
+}
+
+func (s *countingPairStore) GetRevisions(ctx context.Context, doc string) ([]server.PairRevision, error) {
+	s.mu.Lock()
+	s.loads[doc]++
+	s.mu.Unlock()
+	return s.MemPairStore.GetRevisions(ctx, doc)
+}
+
+func (s *countingPairStore) loaded(doc string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loads[doc]
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+// replaceText returns an operation replacing the whole of text with replacement.
+func replaceText(text, replacement string) server.Operation {
+	return server.Operation{{Insert: replacement}, {Delete: utf8.RuneCountInString(text)}}
+}
+
+func readDocument(t testing.TB, ws *websocket.Conn) server.DocumentPayload {
+	t.Helper()
+	env := readEnvelope(t, ws)
+	assertEnvelope(t, env, server.DocumentMessage, "")
+
+	var doc server.DocumentPayload
+	if err := json.Unmarshal(env.Payload, &doc); err != nil {
+		t.Fatalf("could not decode document payload %s, %v", env.Payload, err)
+	}
+	return doc
+}
+
+func getDocumentFromBody(t testing.TB, response *httptest.ResponseRecorder) server.DocumentPayload {
+	t.Helper()
+	var doc server.DocumentPayload
+	if err := json.NewDecoder(response.Body).Decode(&doc); err != nil {
+		t.Fatalf("could not decode document from %q, %v", response.Body.String(), err)
+	}
+	return doc
+}
+
+func readOperation(t testing.TB, env server.Envelope) server.OperationPayload {
+	t.Helper()
+	var op server.OperationPayload
+	if err := json.Unmarshal(env.Payload, &op); err != nil {
+		t.Fatalf("could not decode operation payload %s, %v", env.Payload, err)
+	}
+	return op
+}
+
+func assertDocument(t testing.TB, got server.DocumentPayload, revision int, text string) {
+	t.Helper()
+	if got.Revision != revision || got.Text != text {
+		t.Errorf("got %q at revision %d, want %q at revision %d", got.Text, got.Revision, text, revision)
+	}
+}
+
+func readPresence(t testing.TB, env server.Envelope, messageType string) server.PresenceEvent {
+	t.Helper()
+	assertEnvelope(t, env, messageType, "")
+	var p server.PresenceEvent
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		t.Fatalf("could not decode %s payload %s, %v", messageType, env.Payload, err)
+	}
+	return p
+}
+
+func assertPresenceEvent(t testing.TB, env server.Envelope, event string, client int) {
+	t.Helper()
+	if got := readPresence(t, env, server.PresenceMessage); got.Event != event || got.Client != client {
+		t.Errorf("got %s of client %d, want %s of client %d", got.Event, got.Client, event, client)
+	}
 }
 
-func assertRightMessage(t *testing.T, want, got []byte) {
-	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Did not receieve the right message, wanted %s, got %s", want, got)
+func assertRevision(t testing.TB, got server.OperationPayload, want int) {
+	t.Helper()
+	if got.Revision != want {
+		t.Errorf("got revision %d, want %d", got.Revision, want)
 	}
 }
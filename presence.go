@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	CursorMessage   = "cursor"
+	PresenceMessage = "presence"
+
+	JoinPresence  = "join"
+	LeavePresence = "leave"
+)
+
+var InvalidPositionErr = errors.New("Cursor and selections must be positions within the document, from 0 to its length.")
+
+// Presence is where a client editing a pair document is: its cursor and selections, as
+// positions in the document at Revision. Client identifies the client within the document,
+// and User is the name it connected with, if any.
+type Presence struct {
+	Client     int         `json:"client"`
+	User       string      `json:"user,omitempty"`
+	Revision   int         `json:"revision"`
+	Cursor     int         `json:"cursor"`
+	Selections []Selection `json:"selections,omitempty"`
+}
+
+// Selection is a range of a document selected from Anchor to Head, which is before Anchor when
+// it was selected backwards.
+type Selection struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
+
+// PresenceEvent tells the clients of a document that a client joined or left it.
+type PresenceEvent struct {
+	Event string `json:"event"`
+	Presence
+}
+
+// rebase moves the positions of p over op, which takes the document from p.Revision to the
+// next revision.
+func (p *Presence) rebase(op Operation) {
+	p.Cursor = op.TransformIndex(p.Cursor)
+	for i := range p.Selections {
+		p.Selections[i].Anchor = op.TransformIndex(p.Selections[i].Anchor)
+		p.Selections[i].Head = op.TransformIndex(p.Selections[i].Head)
+	}
+	p.Revision++
+}
+
+func (p Presence) within(length int) bool {
+	if p.Cursor < 0 || p.Cursor > length {
+		return false
+	}
+	for _, s := range p.Selections {
+		if s.Anchor < 0 || s.Anchor > length || s.Head < 0 || s.Head > length {
+			return false
+		}
+	}
+	return true
+}
+
+// peers returns the presence of every client of the document but client, in the order they
+// joined. It must be called with mu held.
+func (d *pairDocument) peers(client *ClientWS) []Presence {
+	peers := make([]Presence, 0, len(d.clients))
+	for other, p := range d.clients {
+		if other != client {
+			peers = append(peers, *p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Client < peers[j].Client })
+	return peers
+}
+
+// others returns every client of the document but client. It must be called with mu held.
+func (d *pairDocument) others(client *ClientWS) []*ClientWS {
+	others := make([]*ClientWS, 0, len(d.clients))
+	for other := range d.clients {
+		if other != client {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+// sendPresence sends frame to every client of doc but client. It must be called with doc.mu
+// held, so that it reaches them in order with the operations.
+func (s *Server) sendPresence(doc *pairDocument, client *ClientWS, frameType string, payload interface{}) error {
+	others := doc.others(client)
+	if len(others) == 0 {
+		return nil
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return s.queuePairDelivery(pairDelivery{clients: others, frame: Envelope{Type: frameType, Payload: raw}})
+}
+
+// joinPairDocument registers client with the manager and opens document name for it, as user.
+// client receives the document along with where its other clients are, and they receive a
+// join presence event.
+func (s *Server) joinPairDocument(ctx context.Context, name, user string, client *ClientWS) (*pairDocument, error) {
+	// Registered before joining, so that no operation sent to the document's clients misses it.
+	s.socketManager.AddClient(client)
+
+	doc, err := s.pairs.lock(ctx, s.PairStore, name)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.mu.Unlock()
+
+	doc.lastClient++
+	p := &Presence{Client: doc.lastClient, User: user, Revision: doc.revision}
+	payload, err := json.Marshal(DocumentPayload{Revision: doc.revision, Text: doc.text, Client: p.Client, Peers: doc.peers(client)})
+	if err != nil {
+		return nil, err
+	}
+	if err := client.SendFrames([]interface{}{Envelope{Type: DocumentMessage, Payload: payload}}); err != nil {
+		return nil, err
+	}
+	doc.clients[client] = p
+	if err := s.sendPresence(doc, client, PresenceMessage, PresenceEvent{Event: JoinPresence, Presence: *p}); err != nil {
+		log.Printf("Dropped join presence of client %d of %s, %v", p.Client, doc.name, err)
+	}
+	return doc, nil
+}
+
+// leavePairDocument closes doc for client, tells its other clients with a leave presence event
+// and removes client from the manager. The document stays open until it is evicted, so that a
+// client reconnecting soon after does not have to wait for it to be loaded.
+func (s *Server) leavePairDocument(doc *pairDocument, client *ClientWS, err error) {
+	doc.mu.Lock()
+	if p, ok := doc.clients[client]; ok {
+		delete(doc.clients, client)
+		if len(doc.clients) == 0 {
+			doc.idleSince = time.Now()
+		}
+		if err := s.sendPresence(doc, client, PresenceMessage, PresenceEvent{Event: LeavePresence, Presence: *p}); err != nil {
+			log.Printf("Dropped leave presence of client %d of %s, %v", p.Client, doc.name, err)
+		}
+	}
+	doc.mu.Unlock()
+
+	s.dropClient(client, err)
+}
+
+// movePairCursor updates where client is in doc to the cursor and selections in payload,
+// rebased over the operations applied since their revision, and sends them to every other
+// client of doc. Cursor messages are not acked, as clients send a new one whenever they move.
+func (s *Server) movePairCursor(doc *pairDocument, client *ClientWS, payload json.RawMessage) error {
+	var moved Presence
+	if err := decodePayload(payload, &moved); err != nil {
+		return err
+	}
+
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+
+	p, ok := doc.clients[client]
+	if !ok {
+		return ClientClosedErr
+	}
+	base := doc.revision - len(doc.history)
+	if moved.Revision < base || moved.Revision > doc.revision {
+		return InvalidRevisionErr
+	}
+	length := utf8.RuneCountInString(doc.text)
+	if moved.Revision < doc.revision {
+		length = doc.history[moved.Revision-base].BaseLength()
+	}
+	if !moved.within(length) {
+		return InvalidPositionErr
+	}
+	for _, op := range doc.history[moved.Revision-base:] {
+		moved.rebase(op)
+	}
+
+	moved.Client, moved.User = p.Client, p.User
+	*p = moved
+	return s.sendPresence(doc, client, CursorMessage, moved)
+}
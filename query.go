@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// ThreadQuery selects live threads in the order they were saved. The zero value matches every
+// thread; each filter that is set narrows the match further.
+type ThreadQuery struct {
+	Limit     int       // At most this many threads are returned; 0 returns every match.
+	Cursor    string    // NextCursor of the previous page, to carry on after it.
+	User      string    // Only threads posted by User.
+	Community string    // Only threads in Community.
+	Since     time.Time // Only threads created at or after Since.
+	MinScore  *int      // Only threads with at least MinScore net votes.
+}
+
+// ThreadPage is one page of threads matching a ThreadQuery. NextCursor is empty on the last page.
+type ThreadPage struct {
+	Threads    Threads
+	NextCursor string
+}
+
+// WeightedThreadPage is the response to a paged GET /thread.
+type WeightedThreadPage struct {
+	Threads    WeightedThreads `json:"threads"`
+	NextCursor string          `json:"next_cursor"`
+}
+
+func (q ThreadQuery) matches(t Thread) bool {
+	switch {
+	case t.Deleted:
+		return false
+	case q.User != "" && t.User != q.User:
+		return false
+	case q.Community != "" && t.Community != q.Community:
+		return false
+	case t.CreatedAt.Before(q.Since):
+		return false
+	case q.MinScore != nil && t.UpVotesCount-t.DownVotesCount < *q.MinScore:
+		return false
+	}
+	return true
+}
+
+// query returns copies of the threads matching q, cloning only those on the page. The cursor
+// holds the ID of the last thread on the previous page, which stays put as a tombstone when it
+// is deleted, so pages neither skip nor repeat threads while others are posted or deleted.
+// When communities is set, a query for a community only looks at the threads it lists.
+func (ts Threads) query(q ThreadQuery, communities communityIndex) (ThreadPage, error) {
+	start := 0
+	if q.Cursor != "" {
+		after, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return ThreadPage{}, err
+		}
+		start = ts.position(after)
+		if start < 0 {
+			return ThreadPage{}, InvalidCursorErr
+		}
+		start++
+	}
+
+	page := ThreadPage{Threads: Threads{}}
+	// collect adds t to the page when it matches, and reports whether the page is complete.
+	collect := func(t Thread) bool {
+		if !q.matches(t) {
+			return false
+		}
+		if q.Limit > 0 && len(page.Threads) == q.Limit {
+			page.NextCursor = encodeCursor(page.Threads[len(page.Threads)-1].ID)
+			return true
+		}
+		page.Threads = append(page.Threads, t.clone())
+		return false
+	}
+
+	if q.Community != "" && communities != nil {
+		positions := communities[q.Community]
+		for _, i := range positions[sort.SearchInts(positions, start):] {
+			if collect(ts[i]) {
+				break
+			}
+		}
+		return page, nil
+	}
+	for _, t := range ts[start:] {
+		if collect(t) {
+			break
+		}
+	}
+	return page, nil
+}
+
+// position returns where thread id is kept, tombstones included, or -1.
+func (ts Threads) position(id int) int {
+	for i, t := range ts {
+		if t.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, InvalidCursorErr
+	}
+	id, err := strconv.Atoi(string(raw))
+	if err != nil {
+		return 0, InvalidCursorErr
+	}
+	return id, nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	HotRanking           = "hot"
+	TopRanking           = "top"
+	ControversialRanking = "controversial"
+	NewRanking           = "new"
+
+	// hotGravity controls how quickly hot threads sink as they age, see HotRank.
+	hotGravity = 1.8
+)
+
+// Ranker scores a thread at a point in time; higher scores rank first.
+type Ranker func(thread Thread, now time.Time) float64
+
+// Rankers holds the ranking algorithms selectable with GET /thread?sort={name}.
+var Rankers = map[string]Ranker{
+	HotRanking:           HotRank,
+	TopRanking:           TopRank,
+	ControversialRanking: ControversialRank,
+	NewRanking:           NewRank,
+}
+
+// RankThreads returns a copy of threads ordered by the named ranking, best first.
+// Threads with equal scores keep their original order.
+func RankThreads(threads Threads, ranking string, now time.Time) (Threads, error) {
+	rank, ok := Rankers[ranking]
+	if !ok {
+		return nil, InvalidRankingErr
+	}
+
+	scores := make([]float64, len(threads))
+	order := make([]int, len(threads))
+	for i, t := range threads {
+		scores[i] = rank(t, now)
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return scores[order[a]] > scores[order[b]]
+	})
+
+	ranked := make(Threads, len(threads))
+	for i, j := range order {
+		ranked[i] = threads[j]
+	}
+	return ranked, nil
+}
+
+// HotRank decays a thread's activity (net votes and comments) with its age in hours, so fresh
+// threads with some activity float above older, more popular ones.
+func HotRank(t Thread, now time.Time) float64 {
+	activity := float64(t.UpVotesCount-t.DownVotesCount) + float64(len(t.Comments))/2 + 1
+	age := now.Sub(t.CreatedAt).Hours()
+	if age < 0 {
+		age = 0
+	}
+	return activity / math.Pow(age+2, hotGravity)
+}
+
+// TopRank ranks by net votes.
+func TopRank(t Thread, now time.Time) float64 {
+	return float64(t.UpVotesCount - t.DownVotesCount)
+}
+
+// ControversialRank favours threads with many votes that are split evenly between up and down.
+func ControversialRank(t Thread, now time.Time) float64 {
+	up, down := float64(t.UpVotesCount), float64(t.DownVotesCount)
+	if up <= 0 || down <= 0 {
+		return 0
+	}
+
+	balance := down / up
+	if up < down {
+		balance = up / down
+	}
+	return math.Pow(up+down, balance)
+}
+
+// NewRank ranks the most recently created threads first.
+func NewRank(t Thread, now time.Time) float64 {
+	return float64(t.CreatedAt.Unix()) + float64(t.CreatedAt.Nanosecond())/float64(time.Second)
+}
+
+const (
+	// weightHalfLife is how long it takes for a thread's bubble weight to halve without new activity.
+	weightHalfLife = 6 * time.Hour
+	// weightPivot is the decayed activity at which a bubble reaches half of its maximum size.
+	weightPivot = 5.0
+	// weightStep is how far a bubble weight has to move before a refresh sends it again.
+	weightStep = 0.01
+
+	DefaultWeightRefreshInterval = time.Minute
+)
+
+// WeightedThread is a Thread along with its bubble weight, as sent to clients.
+type WeightedThreads []WeightedThread
+type WeightedThread struct {
+	Thread
+	Weight float64
+}
+
+// BubbleWeight returns a weight in [0, 1) used by every client to size a thread's bubble.
+// Weight grows with net votes and comments and halves every weightHalfLife, so bubbles
+// shrink as threads age even when nobody interacts with them.
+func BubbleWeight(t Thread, now time.Time) float64 {
+	activity := float64(t.UpVotesCount-t.DownVotesCount) + float64(len(t.Comments)) + 1
+	if activity < 1 {
+		activity = 1
+	}
+
+	age := now.Sub(t.CreatedAt)
+	if age < 0 {
+		age = 0
+	}
+	decayed := activity * math.Pow(0.5, float64(age)/float64(weightHalfLife))
+
+	return decayed / (decayed + weightPivot)
+}
+
+// WeighThreads pairs every thread with its bubble weight, keeping their order.
+func WeighThreads(threads Threads, now time.Time) WeightedThreads {
+	weighted := make(WeightedThreads, len(threads))
+	for i, t := range threads {
+		weighted[i] = WeightedThread{Thread: t, Weight: BubbleWeight(t, now)}
+	}
+	return weighted
+}
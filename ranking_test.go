@@ -0,0 +1,126 @@
+package server_test
+
+import (
+	"server"
+	"testing"
+	"time"
+)
+
+func TestRankers(t *testing.T) {
+	now := time.Now()
+
+	testcases := []struct {
+		name    string
+		rank    server.Ranker
+		better  server.Thread
+		worse   server.Thread
+		comment string
+	}{
+		{
+			name:    "hot prefers fresh threads with the same votes",
+			rank:    server.HotRank,
+			better:  server.Thread{UpVotesCount: 5, CreatedAt: now.Add(-time.Hour)},
+			worse:   server.Thread{UpVotesCount: 5, CreatedAt: now.Add(-24 * time.Hour)},
+			comment: "older thread should decay",
+		},
+		{
+			name:    "hot counts comments as activity",
+			rank:    server.HotRank,
+			better:  server.Thread{CreatedAt: now, Comments: server.Comments{{ID: 1}, {ID: 2}}},
+			worse:   server.Thread{CreatedAt: now},
+			comment: "commented thread should be more active",
+		},
+		{
+			name:    "top prefers net votes regardless of age",
+			rank:    server.TopRank,
+			better:  server.Thread{UpVotesCount: 5, DownVotesCount: 1, CreatedAt: now.Add(-24 * time.Hour)},
+			worse:   server.Thread{UpVotesCount: 3, CreatedAt: now},
+			comment: "higher net votes should rank first",
+		},
+		{
+			name:    "controversial prefers evenly split votes",
+			rank:    server.ControversialRank,
+			better:  server.Thread{UpVotesCount: 4, DownVotesCount: 4},
+			worse:   server.Thread{UpVotesCount: 10, DownVotesCount: 1},
+			comment: "even split should be more controversial",
+		},
+		{
+			name:    "new prefers recent threads",
+			rank:    server.NewRank,
+			better:  server.Thread{CreatedAt: now},
+			worse:   server.Thread{UpVotesCount: 100, CreatedAt: now.Add(-time.Minute)},
+			comment: "newer thread should rank first",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			better, worse := tc.rank(tc.better, now), tc.rank(tc.worse, now)
+			if better <= worse {
+				t.Errorf("%s: got %v <= %v", tc.comment, better, worse)
+			}
+		})
+	}
+}
+
+func TestRankThreadsKeepsOrderOfTies(t *testing.T) {
+	threads := server.Threads{
+		{ID: 0, UpVotesCount: 1},
+		{ID: 1, UpVotesCount: 2},
+		{ID: 2, UpVotesCount: 1},
+	}
+
+	got, err := server.RankThreads(threads, server.TopRanking, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error ranking threads, %v", err)
+	}
+
+	want := []int{1, 0, 2}
+	for i, id := range want {
+		if got[i].ID != id {
+			t.Errorf("got thread %d at position %d, want %d", got[i].ID, i, id)
+		}
+	}
+}
+
+func TestBubbleWeight(t *testing.T) {
+	now := time.Now()
+
+	t.Run("weights stay within [0, 1)", func(t *testing.T) {
+		threads := []server.Thread{
+			{CreatedAt: now},
+			{CreatedAt: now, UpVotesCount: 1000000},
+			{CreatedAt: now, DownVotesCount: 1000000},
+			{CreatedAt: now.Add(-365 * 24 * time.Hour)},
+			{},
+		}
+
+		for _, thread := range threads {
+			weight := server.BubbleWeight(thread, now)
+			if weight < 0 || weight >= 1 {
+				t.Errorf("got weight %v for %v, want it within [0, 1)", weight, thread)
+			}
+		}
+	})
+
+	t.Run("weights grow with votes and comments", func(t *testing.T) {
+		quiet := server.BubbleWeight(server.Thread{CreatedAt: now}, now)
+		voted := server.BubbleWeight(server.Thread{CreatedAt: now, UpVotesCount: 3}, now)
+		commented := server.BubbleWeight(server.Thread{CreatedAt: now, Comments: server.Comments{{ID: 1}}}, now)
+
+		if voted <= quiet || commented <= quiet {
+			t.Errorf("got quiet %v, voted %v, commented %v; want activity to grow the weight", quiet, voted, commented)
+		}
+	})
+
+	t.Run("weights shrink as threads age", func(t *testing.T) {
+		thread := server.Thread{CreatedAt: now, UpVotesCount: 10}
+
+		fresh := server.BubbleWeight(thread, now)
+		later := server.BubbleWeight(thread, now.Add(12*time.Hour))
+
+		if later >= fresh {
+			t.Errorf("got weight %v after 12 hours, want less than %v", later, fresh)
+		}
+	})
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	DefaultSearchResults = 20
+
+	// userFieldBoost weighs a match on a thread's User above one in its Content.
+	userFieldBoost = 2
+)
+
+// SearchResult is a thread matching a search, along with how well it matched.
+type SearchResults []SearchResult
+type SearchResult struct {
+	WeightedThread
+	Score float64
+}
+
+// searchIndex is an inverted index over the Content and User of every live thread. It maps each
+// term to the threads holding it and the positions it holds there, so that phrases can be
+// matched without reading the threads themselves.
+type searchIndex struct {
+	mu       sync.RWMutex
+	built    bool
+	docs     map[int]indexedThread
+	postings map[string]map[int]*termPositions
+
+	termsMu sync.Mutex // Lets searches, which only hold mu for reading, cache terms.
+	terms   []string   // Every key of postings, sorted for prefix matching; nil when out of date.
+}
+
+type indexedThread struct {
+	content string
+	user    string
+}
+
+type termPositions struct {
+	content []int
+	user    []int
+}
+
+// searchClause is one part of a query: a term, a phrase of several terms, or a term prefix.
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{docs: make(map[int]indexedThread), postings: make(map[string]map[int]*termPositions)}
+}
+
+// tokenize splits text into lower case terms of letters and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// parseSearch reads a query made of terms, which must all match. Quoted terms must match as a
+// phrase, in order and next to each other, and a term ending in * matches every term it starts.
+func parseSearch(query string) []searchClause {
+	var clauses []searchClause
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 1 {
+			if terms := tokenize(part); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			terms := tokenize(word)
+			for j, term := range terms {
+				last := j == len(terms)-1
+				clauses = append(clauses, searchClause{terms: []string{term}, prefix: last && strings.HasSuffix(word, "*")})
+			}
+		}
+	}
+	return clauses
+}
+
+// reset must be called with the index locked. It replaces every thread in the index.
+func (idx *searchIndex) reset(threads Threads) {
+	idx.docs = make(map[int]indexedThread, len(threads))
+	idx.postings = make(map[string]map[int]*termPositions)
+	idx.terms = nil
+	for _, t := range threads {
+		idx.add(t)
+	}
+	idx.built = true
+}
+
+// put indexes t as it is now, removing it when it was deleted. Threads whose Content and User
+// did not change, as after a vote, are left alone.
+func (idx *searchIndex) put(t Thread) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if t.Deleted {
+		idx.remove(t.ID)
+		return
+	}
+	if doc, ok := idx.docs[t.ID]; ok && doc.content == t.Content && doc.user == t.User {
+		return
+	}
+	idx.remove(t.ID)
+	idx.add(t)
+}
+
+// add must be called with the index locked, for a thread that is not in it.
+func (idx *searchIndex) add(t Thread) {
+	if t.Deleted {
+		return
+	}
+	idx.docs[t.ID] = indexedThread{content: t.Content, user: t.User}
+	for i, term := range tokenize(t.Content) {
+		p := idx.positions(term, t.ID)
+		p.content = append(p.content, i)
+	}
+	for i, term := range tokenize(t.User) {
+		p := idx.positions(term, t.ID)
+		p.user = append(p.user, i)
+	}
+}
+
+func (idx *searchIndex) positions(term string, id int) *termPositions {
+	threads, ok := idx.postings[term]
+	if !ok {
+		threads = make(map[int]*termPositions)
+		idx.postings[term] = threads
+		idx.terms = nil
+	}
+	p, ok := threads[id]
+	if !ok {
+		p = &termPositions{}
+		threads[id] = p
+	}
+	return p
+}
+
+// remove must be called with the index locked.
+func (idx *searchIndex) remove(id int) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	delete(idx.docs, id)
+	for _, term := range append(tokenize(doc.content), tokenize(doc.user)...) {
+		threads := idx.postings[term]
+		delete(threads, id)
+		if len(threads) == 0 {
+			delete(idx.postings, term)
+			idx.terms = nil
+		}
+	}
+}
+
+// search must be called with the index locked for reading. It returns the IDs of the threads
+// matching every clause, best match first, along with their scores. Matches score by how often
+// their terms occur, weighted towards rare terms and matches on the User.
+func (idx *searchIndex) search(clauses []searchClause) ([]int, map[int]float64) {
+	var scores map[int]float64
+	for _, c := range clauses {
+		matches := idx.match(c)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id := range scores {
+			if score, ok := matches[id]; ok {
+				scores[id] += score
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		if scores[ids[a]] != scores[ids[b]] {
+			return scores[ids[a]] > scores[ids[b]]
+		}
+		return ids[a] > ids[b]
+	})
+	return ids, scores
+}
+
+// match scores every thread matching c.
+func (idx *searchIndex) match(c searchClause) map[int]float64 {
+	scores := make(map[int]float64)
+	switch {
+	case c.prefix:
+		for _, term := range idx.termsWithPrefix(c.terms[0]) {
+			idx.scoreTerm(term, scores)
+		}
+	case len(c.terms) == 1:
+		idx.scoreTerm(c.terms[0], scores)
+	default:
+		idx.scorePhrase(c.terms, scores)
+	}
+	return scores
+}
+
+func (idx *searchIndex) scoreTerm(term string, scores map[int]float64) {
+	threads := idx.postings[term]
+	weight := idx.idf(len(threads))
+	for id, p := range threads {
+		scores[id] += weight * math.Sqrt(float64(len(p.content)+userFieldBoost*len(p.user)))
+	}
+}
+
+func (idx *searchIndex) scorePhrase(terms []string, scores map[int]float64) {
+	weight := 0.0
+	for _, term := range terms {
+		weight += idx.idf(len(idx.postings[term]))
+	}
+	for id, first := range idx.postings[terms[0]] {
+		content := idx.phraseCount(terms, id, first.content, func(p *termPositions) []int { return p.content })
+		user := idx.phraseCount(terms, id, first.user, func(p *termPositions) []int { return p.user })
+		if count := content + userFieldBoost*user; count > 0 {
+			scores[id] += weight * math.Sqrt(float64(count))
+		}
+	}
+}
+
+// phraseCount counts the places in one field of thread id where terms follow each other,
+// given where the first term is.
+func (idx *searchIndex) phraseCount(terms []string, id int, starts []int, field func(*termPositions) []int) int {
+	count := 0
+	for _, start := range starts {
+		found := true
+		for offset, term := range terms[1:] {
+			p, ok := idx.postings[term][id]
+			if !ok || !containsInt(field(p), start+offset+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			count++
+		}
+	}
+	return count
+}
+
+// idf weighs a term held by df threads, so that rare terms count for more than common ones.
+func (idx *searchIndex) idf(df int) float64 {
+	if df == 0 {
+		return 0
+	}
+	return math.Log(1 + float64(len(idx.docs))/float64(df))
+}
+
+// termsWithPrefix must be called with the index locked for reading.
+func (idx *searchIndex) termsWithPrefix(prefix string) []string {
+	terms := idx.sortedTerms()
+	var matches []string
+	for i := sort.SearchStrings(terms, prefix); i < len(terms) && strings.HasPrefix(terms[i], prefix); i++ {
+		matches = append(matches, terms[i])
+	}
+	return matches
+}
+
+func (idx *searchIndex) sortedTerms() []string {
+	idx.termsMu.Lock()
+	defer idx.termsMu.Unlock()
+	if idx.terms != nil {
+		return idx.terms
+	}
+	idx.terms = make([]string, 0, len(idx.postings))
+	for term := range idx.postings {
+		idx.terms = append(idx.terms, term)
+	}
+	sort.Strings(idx.terms)
+	return idx.terms
+}
+
+func containsInt(sorted []int, n int) bool {
+	i := sort.SearchInts(sorted, n)
+	return i < len(sorted) && sorted[i] == n
+}
+
+// indexThreads must be called with eventsMu held, so that no change is published while the
+// index is built. It reads every thread from the store into the index.
+func (s *Server) indexThreads(ctx context.Context) error {
+	threads, err := s.store.GetThreads(ctx)
+	if err != nil {
+		return storeFailure(err)
+	}
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	s.index.reset(threads)
+	return nil
+}
+
+// search returns up to limit threads matching query, best match first. The index is built from
+// the store when it has not been yet, as when the store failed while the server started.
+func (s *Server) search(ctx context.Context, query string, limit int) (SearchResults, error) {
+	clauses := parseSearch(query)
+	if len(clauses) == 0 {
+		return nil, EmptySearchErr
+	}
+
+	s.index.mu.RLock()
+	built := s.index.built
+	s.index.mu.RUnlock()
+	if !built {
+		s.eventsMu.Lock()
+		err := s.indexThreads(ctx)
+		s.eventsMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.index.mu.RLock()
+	ids, scores := s.index.search(clauses)
+	s.index.mu.RUnlock()
+
+	results := SearchResults{}
+	now := time.Now()
+	for _, id := range ids {
+		if len(results) == limit {
+			break
+		}
+		thread, err := s.store.GetThreadByID(ctx, id)
+		if err == MissingThreadErr {
+			continue // Deleted since it was found.
+		}
+		if err != nil {
+			return nil, storeFailure(err)
+		}
+		results = append(results, SearchResult{WeightedThread: WeightedThread{Thread: thread, Weight: BubbleWeight(thread, now)}, Score: scores[id]})
+	}
+	return results, nil
+}
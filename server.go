@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,22 +9,41 @@ import (
 	"net/http"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 const (
 	JSONContentType         = "application/json"
+	maxNameLength           = 32
 	UnreadablePayloadErrMsg = "Unable to decode payload"
+	StoreFailureErrMsg      = "Unable to reach the thread store, please try again."
 )
 
 var (
-	allowedOrigins   = []string{"http://localhost:3000", "https://wassup-bub.netlify.app"}
-	InvalidIDErr     = errors.New("Invalid ID provided")
-	EmptyContentErr  = errors.New("Thread content must have at least 1 character.")
-	MissingUserErr   = errors.New("Thread is missing a user.")
-	MissingThreadErr = errors.New("The thread you are looking for does not exists.")
-	wsUpgrader       = websocket.Upgrader{
+	allowedOrigins      = []string{"http://localhost:3000", "https://wassup-bub.netlify.app"}
+	InvalidIDErr        = errors.New("Invalid ID provided")
+	EmptyContentErr     = errors.New("Thread content must have at least 1 character.")
+	MissingUserErr      = errors.New("Thread is missing a user.")
+	MissingThreadErr    = errors.New("The thread you are looking for does not exists.")
+	InvalidVoteErr      = errors.New("Vote value must be 1 (up), -1 (down) or 0 (retract).")
+	MissingVoterErr     = errors.New("Vote is missing a user.")
+	EmptyCommentErr     = errors.New("Comment content must have at least 1 character.")
+	MissingCommenterErr = errors.New("Comment is missing a user.")
+	MissingCommentErr   = errors.New("The comment you are looking for does not exists.")
+	InvalidRankingErr   = errors.New("Unknown sort, expected one of hot, top, controversial or new.")
+	ServerClosedErr     = errors.New("The server is shutting down.")
+	UnsupportedErr      = errors.New("The thread store does not support this operation.")
+	InvalidCursorErr    = errors.New("Invalid cursor, expected the next_cursor of a previous page.")
+	InvalidQueryErr     = errors.New("Invalid query, limit must be a positive integer, min_score an integer and since an RFC 3339 time.")
+	InvalidCommunityErr = errors.New("Community names must be 1 to 32 lower case letters, digits, dashes or underscores.")
+	InvalidDocumentErr  = errors.New("Document names must be 1 to 32 lower case letters, digits, dashes or underscores.")
+	EmptySearchErr      = errors.New("Search query must have at least 1 letter or digit.")
+	PagedRankingErr     = errors.New("sort cannot be combined with limit or cursor, pages follow the order threads were saved in.")
+	wsUpgrader          = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 		CheckOrigin: func(r *http.Request) bool {
@@ -36,37 +56,103 @@ var (
 	}
 )
 
+// ThreadStore is the original store interface, kept for existing implementations.
+// Wrap one with AdaptThreadStore to use it with NewServer.
 type ThreadStore interface {
 	SaveThread(thread Thread)
 	GetThreads() Threads
+	Vote(vote Vote) (Thread, error)
+	SaveComment(comment Comment) (Comment, error)
+	GetComments(threadID int) (Comments, error)
+}
+
+// ThreadStoreV2 keeps the threads served by the Server. Every method gives up once ctx is done,
+// and reports failures so that they reach the client instead of passing for success.
+// MissingThreadErr and MissingCommentErr report a request for something that does not exist.
+// SaveThread gives the thread the next ID, which is never reused, not even after the thread is
+// deleted or the store restarted, and returns the thread as saved. UpdateThread only changes a
+// thread's Content. DeleteThread leaves a tombstone with Deleted
+// set, which other methods treat as missing, and returns it. QueryThreads returns one page of
+// the threads matching a ThreadQuery, or InvalidCursorErr for a cursor it did not hand out.
+type ThreadStoreV2 interface {
+	SaveThread(ctx context.Context, thread Thread) (Thread, error)
+	GetThreads(ctx context.Context) (Threads, error)
+	QueryThreads(ctx context.Context, query ThreadQuery) (ThreadPage, error)
+	GetThreadByID(ctx context.Context, id int) (Thread, error)
+	UpdateThread(ctx context.Context, thread Thread) (Thread, error)
+	DeleteThread(ctx context.Context, id int) (Thread, error)
+	Vote(ctx context.Context, vote Vote) (Thread, error)
+	SaveComment(ctx context.Context, comment Comment) (Comment, error)
+	GetComments(ctx context.Context, threadID int) (Comments, error)
 }
 
 type Server struct {
 	http.Handler
-	socketManager WebSocketManager
-	store         ThreadStore
-	threadChannel chan Thread
-	sendChannel   chan string
+	SocketConfig    SocketConfig
+	PairIdleTimeout time.Duration // How long a /pair document nobody is editing is kept in memory; DefaultPairIdleTimeout when not positive.
+	PairStore       PairStore     // Keeps the revisions of /pair documents; in memory by default.
 
-	text []byte
+	socketManager WebSocketManager
+	store         ThreadStoreV2
+	threadChannel chan threadRequest
+	sendChannel   chan pairDelivery
+	eventChannel  chan delivery
+	ranking       string
+
+	eventsMu     sync.Mutex
+	seq          uint64 // How many changes were published, from initialSeq.
+	feeds        map[string]*feed
+	weights      map[int]float64 // The bubble weight last sent for each thread.
+	eventsClosed bool
+	index        *searchIndex // Kept up to date as changes are published.
+
+	closingMu sync.RWMutex // Held for reading while queueing to threadChannel or sendChannel.
+	closing   bool
+	quit      chan struct{}
+	savers    sync.WaitGroup
+	updaters  sync.WaitGroup
+
+	weightRefreshInterval time.Duration
+
+	pairs *pairDocuments
 }
 
-func NewServer(store ThreadStore, WSManager WebSocketManager) *Server {
+func NewServer(store ThreadStoreV2, WSManager WebSocketManager) *Server {
 	s := new(Server)
 
 	s.store = store
-	s.text = []byte("hi, enter text here")
+	s.SocketConfig = DefaultSocketConfig
+	s.PairIdleTimeout = DefaultPairIdleTimeout
+	s.PairStore = &MemPairStore{}
+	s.pairs = newPairDocuments()
 	s.socketManager = WSManager
-	s.threadChannel = make(chan Thread, 3)
-	s.sendChannel = make(chan string, 3)
+	s.ranking = HotRanking
+	s.weightRefreshInterval = DefaultWeightRefreshInterval
+	s.threadChannel = make(chan threadRequest, 3)
+	s.sendChannel = make(chan pairDelivery, 3)
+	s.eventChannel = make(chan delivery, 3)
+	s.quit = make(chan struct{})
+	s.seq = initialSeq()
+	s.feeds = make(map[string]*feed)
+	s.weights = make(map[int]float64)
+	s.index = newSearchIndex()
+
+	s.eventsMu.Lock()
+	if err := s.indexThreads(context.Background()); err != nil {
+		log.Printf("Unable to build the search index, it will be built on the first search, %v", err)
+	}
+	s.eventsMu.Unlock()
 
 	router := http.NewServeMux()
 	router.Handle("/", http.HandlerFunc(s.homeHandler))
 	router.Handle("/thread", http.HandlerFunc(s.threadHandler))
 	router.Handle("/thread/", http.HandlerFunc(s.singleThreadHandler))
+	router.Handle("/thread/search", http.HandlerFunc(s.searchHandler))
+	router.Handle("/c/", http.HandlerFunc(s.communityHandler))
 	router.Handle("/ws", http.HandlerFunc(s.chatHandler)) // TO BE DEPRECATED
 	router.Handle("/chat", http.HandlerFunc(s.chatHandler))
 	router.Handle("/pair", http.HandlerFunc(s.pairHandler))
+	router.Handle("/pair/", http.HandlerFunc(s.pairHandler))
 
 	s.Handler = router
 
@@ -78,10 +164,31 @@ func (s *Server) homeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) threadHandler(w http.ResponseWriter, r *http.Request) {
+	s.threadsHandler(w, r, "")
+}
+
+// communityHandler serves /c/{community}/thread like /thread, but for the threads of community.
+func (s *Server) communityHandler(w http.ResponseWriter, r *http.Request) {
+	community, ok, err := getCommunityPathFromRequest(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.threadsHandler(w, r, community)
+}
+
+// threadsHandler lists and posts threads, in community when it is set and across every
+// community otherwise.
+func (s *Server) threadsHandler(w http.ResponseWriter, r *http.Request, community string) {
 	if OriginIsAllowed(r) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,access-control-allow-origin, access-control-allow-headers")
+	}
+	if !allowCORS(w, r, "GET, POST") {
+		return
 	}
 	switch r.Method {
 
@@ -89,8 +196,12 @@ func (s *Server) threadHandler(w http.ResponseWriter, r *http.Request) {
 		thread, err := GetThreadFromReader(r.Body)
 		if err != nil {
 			http.Error(w, UnreadablePayloadErrMsg, http.StatusBadRequest)
+			return
 		}
 
+		if community != "" {
+			thread.Community = community
+		}
 		err = s.checkThread(thread)
 
 		if err != nil {
@@ -98,59 +209,394 @@ func (s *Server) threadHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		threadID := len(s.store.GetThreads())
-		thread.ID = threadID
-		s.store.SaveThread(thread)
+		thread, err = s.saveThread(r.Context(), thread)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 
 		json.NewEncoder(w).Encode(thread)
 
-		s.socketManager.Broadcast(s.socketManager.GetChatClients(), s.store.GetThreads())
-
 	default:
+		query, paged, err := getThreadQueryFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if community != "" {
+			query.Community = community
+		}
+		ranking := r.URL.Query().Get("sort")
+		if paged && ranking != "" {
+			http.Error(w, PagedRankingErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		page, err := s.store.QueryThreads(r.Context(), query)
+		if err != nil {
+			writeError(w, storeFailure(err))
+			return
+		}
+		threads := page.Threads
+		if ranking != "" {
+			ranked, err := RankThreads(threads, ranking, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			threads = ranked
+		}
+
 		w.Header().Set("content-type", JSONContentType)
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(s.store.GetThreads())
+		if paged {
+			json.NewEncoder(w).Encode(WeightedThreadPage{Threads: WeighThreads(threads, time.Now()), NextCursor: page.NextCursor})
+			return
+		}
+		json.NewEncoder(w).Encode(WeighThreads(threads, time.Now()))
+	}
+}
+
+// getThreadQueryFromRequest reads the filters and paging of GET /thread. The request is paged
+// when it sets limit or cursor; a cursor without a limit gets DefaultPageSize threads, and no
+// page holds more than MaxPageSize.
+func getThreadQueryFromRequest(r *http.Request) (query ThreadQuery, paged bool, err error) {
+	values := r.URL.Query()
+	query.User = values.Get("user")
+	query.Community = values.Get("community")
+	query.Cursor = values.Get("cursor")
+
+	if since := values.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return ThreadQuery{}, false, InvalidQueryErr
+		}
+	}
+	if minScore := values.Get("min_score"); minScore != "" {
+		score, err := strconv.Atoi(minScore)
+		if err != nil {
+			return ThreadQuery{}, false, InvalidQueryErr
+		}
+		query.MinScore = &score
+	}
+
+	limit := values.Get("limit")
+	if limit == "" && query.Cursor == "" {
+		return query, false, nil
+	}
+	query.Limit = DefaultPageSize
+	if limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 1 {
+			return ThreadQuery{}, false, InvalidQueryErr
+		}
+	}
+	if query.Limit > MaxPageSize {
+		query.Limit = MaxPageSize
+	}
+	return query, true, nil
+}
+
+// searchHandler answers GET /thread/search?q={query} with the threads matching query, best
+// match first. See parseSearch for the query syntax.
+func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := DefaultSearchResults
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			http.Error(w, InvalidQueryErr.Error(), http.StatusBadRequest)
+			return
+		}
+		if limit > MaxPageSize {
+			limit = MaxPageSize
+		}
+	}
+
+	results, err := s.search(r.Context(), r.URL.Query().Get("q"), limit)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+
+	w.Header().Set("content-type", JSONContentType)
+	json.NewEncoder(w).Encode(results)
 }
 
 func (s *Server) singleThreadHandler(w http.ResponseWriter, r *http.Request) {
-	index, err := s.GetIDFromRequest(r)
+	id, action, err := s.getThreadPathFromRequest(r)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	threads := s.store.GetThreads()
+	methods := map[string]string{"": "GET, PATCH, DELETE", "vote": "POST", "comments": "GET, POST"}
+	if m, ok := methods[action]; ok && !allowCORS(w, r, m) {
+		return
+	}
+
+	switch action {
+	case "":
+	case "vote":
+		s.voteHandler(w, r, id)
+		return
+	case "comments":
+		s.commentsHandler(w, r, id)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		thread, err := s.store.GetThreadByID(r.Context(), id)
+		if err != nil {
+			writeError(w, storeFailure(err))
+			return
+		}
+
+		w.Header().Set("content-type", JSONContentType)
+		json.NewEncoder(w).Encode(WeightedThread{Thread: thread, Weight: BubbleWeight(thread, time.Now())})
+
+	case http.MethodPatch:
+		update, err := GetThreadFromReader(r.Body)
+		if err != nil {
+			http.Error(w, UnreadablePayloadErrMsg, http.StatusBadRequest)
+			return
+		}
+		update.ID = id
+
+		if len(update.Content) == 0 {
+			http.Error(w, EmptyContentErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		thread, err := s.updateThread(r.Context(), update)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("content-type", JSONContentType)
+		json.NewEncoder(w).Encode(thread)
+
+	case http.MethodDelete:
+		if err := s.deleteThread(r.Context(), id); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) voteHandler(w http.ResponseWriter, r *http.Request, threadID int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	vote, err := GetVoteFromReader(r.Body)
+	if err != nil {
+		http.Error(w, UnreadablePayloadErrMsg, http.StatusBadRequest)
+		return
+	}
+	vote.ThreadID = threadID
 
-	if index >= len(threads) {
-		http.Error(w, "The thread you are looking for does not exists.", http.StatusNotFound)
+	err = s.checkVote(vote)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(threads[index]) // TODO: add getThreadByID()
+	thread, err := s.vote(r.Context(), vote)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
+	w.Header().Set("content-type", JSONContentType)
+	json.NewEncoder(w).Encode(thread)
+}
+
+func (s *Server) commentsHandler(w http.ResponseWriter, r *http.Request, threadID int) {
+	switch r.Method {
+
+	case http.MethodPost:
+		comment, err := GetCommentFromReader(r.Body)
+		if err != nil {
+			http.Error(w, UnreadablePayloadErrMsg, http.StatusBadRequest)
+			return
+		}
+		comment.ThreadID = threadID
+
+		err = s.checkComment(comment)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		comment, err = s.saveComment(r.Context(), comment)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("content-type", JSONContentType)
+		json.NewEncoder(w).Encode(comment)
+
+	default:
+		comments, err := s.store.GetComments(r.Context(), threadID)
+		if err != nil {
+			writeError(w, storeFailure(err))
+			return
+		}
+
+		w.Header().Set("content-type", JSONContentType)
+		json.NewEncoder(w).Encode(comments)
+	}
 }
 
 func (s *Server) chatHandler(w http.ResponseWriter, r *http.Request) {
-	client := NewClientWS(w, r)
+	communities, err := getCommunitiesFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	client.SendThreads(s.store.GetThreads())
-	s.socketManager.AddClient(client)
+	client, err := NewClientWS(w, r, s.SocketConfig)
+	if err != nil {
+		return
+	}
+	client.communities = communities
+
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	err = s.subscribe(client, since, err == nil)
+	if err != nil {
+		log.Printf("problem sending catch up events %v\n", err)
+		client.Close(websocket.CloseInternalServerErr, "")
+		return
+	}
 
 	go s.ProcessThreadFromClient(client)
 }
 
+// pairHandler connects a client to the document of /pair/{doc}, or DefaultPairDocument for /pair,
+// as the user named by ?user=, and serves the revisions of the document on /pair/{doc}/history
+// and /pair/{doc}/revert.
 func (s *Server) pairHandler(w http.ResponseWriter, r *http.Request) {
-	client := NewClientWS(w, r)
-	s.socketManager.AddClient(client)
-	err := client.WriteMessage(s.text)
+	name, action, err := getPairPathFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "":
+	case action == "history" || strings.HasPrefix(action, "history/"):
+		s.pairHistoryHandler(w, r, name, strings.TrimPrefix(strings.TrimPrefix(action, "history"), "/"))
+		return
+	case action == "revert":
+		s.pairRevertHandler(w, r, name)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	client, err := NewClientWS(w, r, s.SocketConfig)
 	if err != nil {
-		log.Printf("problem sending message %v\n", err)
+		return
+	}
+	doc, err := s.joinPairDocument(r.Context(), name, r.URL.Query().Get("user"), client)
+	if err != nil {
+		log.Printf("problem sending document %v\n", err)
+		s.dropClient(client, err)
+		return
 	}
 
-	go s.ProcessMessageFromClient(client)
+	go s.ProcessMessageFromClient(client, doc)
+}
+
+// pairHistoryHandler serves the revisions of document name, or its text as of revision when
+// it is set.
+func (s *Server) pairHistoryHandler(w http.ResponseWriter, r *http.Request, name, revision string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if revision == "" {
+		revisions, err := s.pairRevisions(r.Context(), name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if revisions == nil {
+			revisions = []PairRevision{}
+		}
+		w.Header().Set("content-type", JSONContentType)
+		json.NewEncoder(w).Encode(revisions)
+		return
+	}
+
+	n, err := strconv.Atoi(revision)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	doc, err := s.pairText(r.Context(), name, n)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("content-type", JSONContentType)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// pairRevertHandler brings document name back to the revision in the body, {"revision": n}.
+func (s *Server) pairRevertHandler(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var revert revertPayload
+	if err := json.NewDecoder(r.Body).Decode(&revert); err != nil || revert.Revision == nil {
+		http.Error(w, UnreadablePayloadErrMsg, http.StatusBadRequest)
+		return
+	}
+	doc, err := s.revertPairDocument(r.Context(), name, *revert.Revision)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("content-type", JSONContentType)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// rankedThreads returns every thread client follows, weighted and in the order chat clients
+// display them.
+func (s *Server) rankedThreads(ctx context.Context, client *ClientWS) (WeightedThreads, error) {
+	all, err := s.store.GetThreads(ctx)
+	if err != nil {
+		return nil, storeFailure(err)
+	}
+	threads := all[:0]
+	for _, t := range all {
+		if client.follows(t.Community) {
+			threads = append(threads, t)
+		}
+	}
+	now := time.Now()
+	threads, _ = RankThreads(threads, s.ranking, now)
+	return WeighThreads(threads, now), nil
 }
 
 func (s *Server) checkThread(thread Thread) error {
@@ -163,6 +609,48 @@ func (s *Server) checkThread(thread Thread) error {
 
 	}
 
+	if thread.Community != "" && !validName(thread.Community) {
+		return InvalidCommunityErr
+	}
+
+	return nil
+}
+
+// validName reports whether name can name a community or a document: 1 to 32 lower case
+// letters, digits, dashes or underscores, so that it can be used as is in paths and topics.
+func validName(name string) bool {
+	if len(name) == 0 || len(name) > maxNameLength {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) checkVote(vote Vote) error {
+	if vote.Value < -1 || vote.Value > 1 {
+		return InvalidVoteErr
+	}
+
+	if len(vote.User) == 0 {
+		return MissingVoterErr
+	}
+
+	return nil
+}
+
+func (s *Server) checkComment(comment Comment) error {
+	if len(comment.Content) == 0 {
+		return EmptyCommentErr
+	}
+
+	if len(comment.User) == 0 {
+		return MissingCommenterErr
+	}
+
 	return nil
 }
 
@@ -176,6 +664,37 @@ func (s *Server) GetIDFromRequest(r *http.Request) (int, error) {
 	return index, nil
 }
 
+// getThreadPathFromRequest splits /thread/{id}/{action} into the thread ID and the (optional) action.
+func (s *Server) getThreadPathFromRequest(r *http.Request) (int, string, error) {
+	segments := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, "/thread/"), "/"), "/", 2)
+	id, err := strconv.Atoi(segments[0])
+
+	if err != nil || id < 0 {
+		return 0, "", InvalidIDErr
+	}
+
+	if len(segments) == 1 {
+		return id, "", nil
+	}
+	return id, segments[1], nil
+}
+
+// allowCORS lets pages from the allowed origins call a route taking methods. It answers the
+// browser's preflight OPTIONS request itself, and then returns false so the handler stops.
+func allowCORS(w http.ResponseWriter, r *http.Request, methods string) bool {
+	if OriginIsAllowed(r) {
+		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,access-control-allow-origin, access-control-allow-headers")
+		w.Header().Set("Access-Control-Allow-Methods", methods+", OPTIONS")
+		w.Header().Add("Vary", "Origin")
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	return true
+}
+
 func OriginIsAllowed(r *http.Request) bool {
 	requestOrigin := r.Header.Get("Origin")
 	for _, origin := range allowedOrigins {
@@ -186,42 +705,122 @@ func OriginIsAllowed(r *http.Request) bool {
 	return false
 }
 
-func NewClientWS(w http.ResponseWriter, r *http.Request) *ClientWS {
+func NewClientWS(w http.ResponseWriter, r *http.Request, config SocketConfig) (*ClientWS, error) {
 	conn, err := wsUpgrader.Upgrade(w, r, nil)
 
 	if err != nil {
 		log.Printf("problem upgrading connection to Websockets %v\n", err)
+		return nil, err
 	}
-	return &ClientWS{socket: conn, pair: r.URL.Path == "/pair"}
+	return newClientWS(conn, isPairPath(r.URL.Path), config), nil
 }
 
 func (s *Server) ProcessThreadFromClient(client *ClientWS) {
 	for {
-		t, err := client.GetThread()
+		frame, err := client.ReadFrame()
 		if err != nil {
-			log.Println("Websocket closed.")
-			s.socketManager.RemoveClient(client)
+			s.dropClient(client, err)
 			return
 		}
 
-		threadErr := s.checkThread(t)
-		if threadErr != nil {
-			log.Println(err)
-			return
+		s.dispatch(client, frame)
+	}
+}
+
+// saveThread saves a new thread, which the store numbers, and publishes it. Only what its
+// author writes is kept: a thread starts without votes or comments.
+func (s *Server) saveThread(ctx context.Context, thread Thread) (saved Thread, err error) {
+	thread = Thread{Content: thread.Content, User: thread.User, Community: thread.Community}
+	err = s.publish(func() (Event, error) {
+		thread.CreatedAt = time.Now()
+		saved, err = s.store.SaveThread(ctx, thread)
+		return threadEvent(ThreadCreatedEvent, saved), storeFailure(err)
+	})
+	return saved, err
+}
+
+// updateThread edits the content of a thread and publishes the edited thread.
+func (s *Server) updateThread(ctx context.Context, update Thread) (thread Thread, err error) {
+	err = s.publish(func() (Event, error) {
+		thread, err = s.store.UpdateThread(ctx, update)
+		return threadEvent(ThreadUpdatedEvent, thread), storeFailure(err)
+	})
+	return thread, err
+}
+
+// deleteThread deletes thread id and publishes its tombstone.
+func (s *Server) deleteThread(ctx context.Context, id int) error {
+	return s.publish(func() (Event, error) {
+		tombstone, err := s.store.DeleteThread(ctx, id)
+		return threadEvent(ThreadDeletedEvent, tombstone), storeFailure(err)
+	})
+}
+
+// vote records vote and publishes the updated thread.
+func (s *Server) vote(ctx context.Context, vote Vote) (thread Thread, err error) {
+	err = s.publish(func() (Event, error) {
+		thread, err = s.store.Vote(ctx, vote)
+		return threadEvent(ThreadUpdatedEvent, thread), storeFailure(err)
+	})
+	return thread, err
+}
+
+// saveComment saves comment and publishes it.
+func (s *Server) saveComment(ctx context.Context, comment Comment) (saved Comment, err error) {
+	err = s.publish(func() (Event, error) {
+		saved, err = s.store.SaveComment(ctx, comment)
+		if err != nil {
+			return Event{}, storeFailure(err)
+		}
+		// The comment is saved by now, so a failed lookup only keeps it from the followers of
+		// the thread's community until their next snapshot.
+		thread, err := s.store.GetThreadByID(ctx, comment.ThreadID)
+		if err != nil {
+			log.Printf("Unable to find the community of thread %d, %v", comment.ThreadID, err)
 		}
-		s.threadChannel <- t
+		return Event{Type: CommentCreatedEvent, Comment: &saved, community: thread.Community}, nil
+	})
+	return saved, err
+}
+
+// writeError answers a request that failed with err. The details of store failures are only logged.
+func writeError(w http.ResponseWriter, err error) {
+	var storeErr StoreError
+	switch {
+	case err == MissingThreadErr || err == MissingCommentErr || err == MissingRevisionErr:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err == ServerClosedErr || contextEnded(err):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case err == UnsupportedErr:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case errors.As(err, &storeErr):
+		http.Error(w, StoreFailureErrMsg, http.StatusInternalServerError)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// dropClient disconnects a client whose reader failed with err and removes it from the manager.
+func (s *Server) dropClient(client *ClientWS, err error) {
+	reason := CloseReason(err)
+	log.Printf("Websocket closed: %s.", reason)
+
+	if reason == missedHeartbeatReason {
+		client.Close(websocket.ClosePolicyViolation, reason)
+	} else {
+		client.Close(websocket.CloseNormalClosure, "")
 	}
+	s.socketManager.RemoveClient(client)
 }
 
-func (s *Server) ProcessMessageFromClient(client *ClientWS) {
+// ProcessMessageFromClient applies the operations client sends to doc until it disconnects.
+func (s *Server) ProcessMessageFromClient(client *ClientWS, doc *pairDocument) {
 	for {
-		_, msg, err := client.socket.ReadMessage()
+		frame, err := client.ReadFrame()
 		if err != nil {
-			log.Println("Websocket closed.")
-			s.socketManager.RemoveClient(client)
+			s.leavePairDocument(doc, client, err)
 			return
 		}
-		s.text = msg
-		s.sendChannel <- "pair"
+		s.dispatchPair(doc, client, frame)
 	}
 }
@@ -2,15 +2,21 @@ package server_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"server"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -23,14 +29,14 @@ func TestServer(t *testing.T) {
 		response := httptest.NewRecorder()
 
 		store := &spyStore{}
-		server := server.NewServer(store, NewSpyClientManager())
+		server := server.NewServer(server.AdaptThreadStore(store), NewSpyClientManager())
 
 		server.ServeHTTP(response, request)
 		assertStatus(t, response, http.StatusOK)
 	})
 
 	t.Run("Post 2 threads and GET request to /thread returns both threads", func(t *testing.T) {
-		testServer := server.NewServer(&spyStore{}, NewSpyClientManager())
+		testServer := server.NewServer(server.AdaptThreadStore(&spyStore{}), NewSpyClientManager())
 
 		firstThreadPayload := newThreadPayload("this is thread 1", "anna")
 		secondThreadPayload := newThreadPayload("this is thread 2", "bob")
@@ -65,188 +71,1429 @@ func TestServer(t *testing.T) {
 
 	})
 
+	t.Run("Post thread with votes and comments and they are not stored", func(t *testing.T) {
+		request := newPOSTRequest("/thread", map[string]interface{}{
+			"Content":        "this is thread 1",
+			"User":           "anna",
+			"UpVotesCount":   100000,
+			"DownVotesCount": 3,
+			"Comments":       []server.Comment{{ID: 1, Content: "first", User: "bob"}},
+			"Deleted":        true,
+		})
+		response := httptest.NewRecorder()
+		store := &server.MemStore{}
+		testServer := server.NewServer(store, NewSpyClientManager())
+		go testServer.StartWorkers()
+
+		testServer.ServeHTTP(response, request)
+		assertStatus(t, response, http.StatusOK)
+
+		want := server.Thread{Content: "this is thread 1", User: "anna"}
+		assertThreadExceptID(t, getThreadFromBody(t, response.Body), want)
+		stored, err := store.GetThreadByID(context.Background(), 0)
+		if err != nil {
+			t.Fatalf("unexpected error getting the thread, %v", err)
+		}
+		assertThreadExceptID(t, stored, want)
+	})
+
 	t.Run("Post empty thread and receive an error", func(t *testing.T) {
 		testThread := newThreadPayload("", "anna")
 
-		request := newPOSTRequest("/thread", testThread)
+		request := newPOSTRequest("/thread", testThread)
+		response := httptest.NewRecorder()
+		store := &spyStore{}
+		testServer := server.NewServer(server.AdaptThreadStore(store), NewSpyClientManager())
+
+		testServer.ServeHTTP(response, request)
+
+		assertStatus(t, response, http.StatusBadRequest)
+		assertError(t, response, server.EmptyContentErr)
+
+		if len(store.threads) != 0 {
+			t.Errorf("Should not have stored bad thread, but it did.")
+		}
+	})
+
+	t.Run("Post unreadable thread and receive a single error", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/thread", strings.NewReader(`{"Content": `))
+		response := httptest.NewRecorder()
+		store := &spyStore{}
+		testServer := server.NewServer(server.AdaptThreadStore(store), NewSpyClientManager())
+
+		testServer.ServeHTTP(response, request)
+
+		assertStatus(t, response, http.StatusBadRequest)
+		assertBodyString(t, response, server.UnreadablePayloadErrMsg+"\n")
+
+		if len(store.threads) != 0 {
+			t.Errorf("Should not have stored unreadable thread, but it did.")
+		}
+	})
+
+	t.Run("Post thread with no user and receive an error", func(t *testing.T) {
+		testThread := newThreadPayload("this is thread 1", "")
+
+		request := newPOSTRequest("/thread", testThread)
+		response := httptest.NewRecorder()
+		store := &spyStore{}
+		testServer := server.NewServer(server.AdaptThreadStore(store), NewSpyClientManager())
+
+		testServer.ServeHTTP(response, request)
+
+		assertStatus(t, response, http.StatusBadRequest)
+		assertError(t, response, server.MissingUserErr)
+
+		if len(store.threads) != 0 {
+			t.Errorf("Should not have stored bad thread, but it did.")
+		}
+	})
+
+	t.Run("GET request to /thread/0 returns first thread", func(t *testing.T) {
+		thread := threadPayloadToThread(newThreadPayload("this is thread 1", "anna"))
+		secondThread := threadPayloadToThread(newThreadPayload("this is thread 2", "karenina"))
+		secondThread.ID = 1
+
+		store := &spyStore{
+			threads: []server.Thread{thread, secondThread},
+		}
+		testServer := server.NewServer(server.AdaptThreadStore(store), NewSpyClientManager())
+
+		request := newGETRequest("/thread/0")
+		response := httptest.NewRecorder()
+
+		testServer.ServeHTTP(response, request)
+
+		d := getThreadFromBody(t, response.Body)
+
+		assertThreadExceptID(t, d, thread)
+
+		request = newGETRequest("/thread/1")
+		response = httptest.NewRecorder()
+
+		testServer.ServeHTTP(response, request)
+
+		d = getThreadFromBody(t, response.Body)
+
+		assertThreadExceptID(t, d, secondThread)
+	})
+
+	t.Run("metrics are not served on the public routes", func(t *testing.T) {
+		testServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+		response := httptest.NewRecorder()
+		testServer.ServeHTTP(response, newGETRequest("/debug/vars"))
+		if strings.Contains(response.Body.String(), "memstats") {
+			t.Errorf("got metrics on the public router: %.80s", response.Body.String())
+		}
+	})
+
+	t.Run("Invalid GET requests to /thread/{id} returns error", func(t *testing.T) {
+
+		store := &spyStore{}
+		testServer := server.NewServer(server.AdaptThreadStore(store), NewSpyClientManager())
+		testcase := []struct {
+			name string
+			url  string
+			err  error
+			code int
+		}{
+			{
+				name: "Getting from empty store",
+				url:  "/thread/0",
+				err:  server.MissingThreadErr,
+				code: http.StatusNotFound,
+			},
+			{
+				name: "Getting with string ID",
+				url:  "/thread/a",
+				err:  server.InvalidIDErr,
+				code: http.StatusBadRequest,
+			},
+			{
+				name: "Getting with negative ID",
+				url:  "/thread/-1",
+				err:  server.InvalidIDErr,
+				code: http.StatusBadRequest,
+			},
+		}
+
+		for _, tc := range testcase {
+			t.Run(tc.name, func(t *testing.T) {
+				request := newGETRequest(tc.url)
+				response := httptest.NewRecorder()
+
+				testServer.ServeHTTP(response, request)
+				assertStatus(t, response, tc.code)
+				assertError(t, response, tc.err)
+			})
+		}
+
+	})
+
+	t.Run("POST request to /thread/{id}/vote updates vote counts", func(t *testing.T) {
+		store := &spyStore{
+			threads: []server.Thread{{ID: 0, Content: "this is thread 1", User: "anna"}},
+		}
+		testServer := server.NewServer(server.AdaptThreadStore(store), NewSpyClientManager())
+		go testServer.StartWorkers()
+
+		response := httptest.NewRecorder()
+		testServer.ServeHTTP(response, newPOSTRequest("/thread/0/vote", votePayload{User: "bob", Value: 1}))
+		assertStatus(t, response, http.StatusOK)
+
+		response = httptest.NewRecorder()
+		testServer.ServeHTTP(response, newPOSTRequest("/thread/0/vote", votePayload{User: "karenina", Value: -1}))
+		assertStatus(t, response, http.StatusOK)
+
+		want := server.Thread{Content: "this is thread 1", User: "anna", UpVotesCount: 1, DownVotesCount: 1}
+		assertThreadExceptID(t, getThreadFromBody(t, response.Body), want)
+		assertThreadExceptID(t, store.threads[0], want)
+	})
+
+	t.Run("responses do not show who voted", func(t *testing.T) {
+		store := &server.MemStore{}
+		store.SaveThread(context.Background(), server.Thread{Content: "this is thread 1", User: "anna"})
+		store.SaveComment(context.Background(), server.Comment{ThreadID: 0, Content: "first", User: "anna"})
+		testServer := server.NewServer(store, NewSpyClientManager())
+		go testServer.StartWorkers()
+
+		for _, vote := range []server.Vote{{User: "bob", Value: 1}, {CommentID: 1, User: "bob", Value: -1}} {
+			response := httptest.NewRecorder()
+			testServer.ServeHTTP(response, newPOSTRequest("/thread/0/vote", vote))
+			assertStatus(t, response, http.StatusOK)
+		}
+
+		for _, path := range []string{"/thread", "/thread/0", "/thread/0/comments"} {
+			response := httptest.NewRecorder()
+			testServer.ServeHTTP(response, newGETRequest(path))
+			assertStatus(t, response, http.StatusOK)
+			if strings.Contains(response.Body.String(), "bob") {
+				t.Errorf("%s shows who voted: %s", path, response.Body.String())
+			}
+		}
+	})
+
+	t.Run("allowed origins can call every /thread/{id} route from a browser", func(t *testing.T) {
+		store := &server.MemStore{}
+		store.SaveThread(context.Background(), server.Thread{Content: "this is thread 1", User: "anna"})
+		testServer := server.NewServer(store, NewSpyClientManager())
+		go testServer.StartWorkers()
+
+		testcases := []struct {
+			name    string
+			request *http.Request
+			status  int
+			method  string
+		}{
+			{"vote preflight", newOPTIONSRequest("/thread/0/vote"), http.StatusNoContent, http.MethodPost},
+			{"comments preflight", newOPTIONSRequest("/thread/0/comments"), http.StatusNoContent, http.MethodPost},
+			{"edit preflight", newOPTIONSRequest("/thread/0"), http.StatusNoContent, http.MethodPatch},
+			{"vote", newPOSTRequest("/thread/0/vote", votePayload{User: "bob", Value: 1}), http.StatusOK, http.MethodPost},
+			{"edit", newPATCHRequest("/thread/0", threadPayload{Content: "edited"}), http.StatusOK, http.MethodPatch},
+			{"delete", newDELETERequest("/thread/0"), http.StatusNoContent, http.MethodDelete},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				tc.request.Header.Set("Origin", "http://localhost:3000")
+				response := httptest.NewRecorder()
+				testServer.ServeHTTP(response, tc.request)
+
+				assertStatus(t, response, tc.status)
+				if got := response.Header().Get("Access-Control-Allow-Origin"); got != "http://localhost:3000" {
+					t.Errorf("got allowed origin %q, want %q", got, "http://localhost:3000")
+				}
+				if got := response.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, tc.method) {
+					t.Errorf("got allowed methods %q, want %s among them", got, tc.method)
+				}
+			})
+		}
+	})
+
+	t.Run("Invalid POST requests to /thread/{id}/vote returns error", func(t *testing.T) {
+		store := &spyStore{
+			threads: []server.Thread{{ID: 0, Content: "this is thread 1", User: "anna"}},
+		}
+		testServer := server.NewServer(server.AdaptThreadStore(store), NewSpyClientManager())
+		testcase := []struct {
+			name string
+			url  string
+			vote votePayload
+			err  error
+			code int
+		}{
+			{
+				name: "Voting on missing thread",
+				url:  "/thread/1/vote",
+				vote: votePayload{User: "bob", Value: 1},
+				err:  server.MissingThreadErr,
+				code: http.StatusNotFound,
+			},
+			{
+				name: "Voting with invalid value",
+				url:  "/thread/0/vote",
+				vote: votePayload{User: "bob", Value: 2},
+				err:  server.InvalidVoteErr,
+				code: http.StatusBadRequest,
+			},
+			{
+				name: "Voting without a user",
+				url:  "/thread/0/vote",
+				vote: votePayload{Value: 1},
+				err:  server.MissingVoterErr,
+				code: http.StatusBadRequest,
+			},
+		}
+
+		for _, tc := range testcase {
+			t.Run(tc.name, func(t *testing.T) {
+				response := httptest.NewRecorder()
+
+				testServer.ServeHTTP(response, newPOSTRequest(tc.url, tc.vote))
+				assertStatus(t, response, tc.code)
+				assertError(t, response, tc.err)
+			})
+		}
+	})
+
+	t.Run("GET request to /thread?sort= returns ranked threads", func(t *testing.T) {
+		now := time.Now()
+		old := server.Thread{ID: 0, Content: "old and popular", User: "anna", UpVotesCount: 10, CreatedAt: now.Add(-48 * time.Hour)}
+		fresh := server.Thread{ID: 1, Content: "fresh", User: "bob", UpVotesCount: 1, CreatedAt: now}
+		split := server.Thread{ID: 2, Content: "split", User: "karenina", UpVotesCount: 3, DownVotesCount: 3, CreatedAt: now.Add(-time.Hour)}
+
+		store := &spyStore{threads: []server.Thread{old, fresh, split}}
+		testServer := server.NewServer(server.AdaptThreadStore(store), NewSpyClientManager())
+
+		testcases := []struct {
+			sort string
+			want []server.Thread
+		}{
+			{server.HotRanking, []server.Thread{fresh, split, old}},
+			{server.TopRanking, []server.Thread{old, fresh, split}},
+			{server.ControversialRanking, []server.Thread{split, old, fresh}},
+			{server.NewRanking, []server.Thread{fresh, split, old}},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.sort, func(t *testing.T) {
+				response := httptest.NewRecorder()
+				testServer.ServeHTTP(response, newGETRequest("/thread?sort="+tc.sort))
+
+				assertStatus(t, response, http.StatusOK)
+				assertThreads(t, getThreadsFromBody(t, response.Body), tc.want)
+			})
+		}
+
+		t.Run("threads carry their bubble weight", func(t *testing.T) {
+			response := httptest.NewRecorder()
+			testServer.ServeHTTP(response, newGETRequest("/thread"))
+
+			var got []server.WeightedThread
+			json.NewDecoder(response.Body).Decode(&got)
+
+			for i, thread := range got {
+				want := server.BubbleWeight(store.threads[i], now)
+				if thread.Weight <= 0 || thread.Weight >= 1 || thread.Weight > want {
+					t.Errorf("got weight %v for %q, want it within (0, %v]", thread.Weight, thread.Content, want)
+				}
+			}
+		})
+
+		t.Run("unknown sort", func(t *testing.T) {
+			response := httptest.NewRecorder()
+			testServer.ServeHTTP(response, newGETRequest("/thread?sort=best"))
+
+			assertStatus(t, response, http.StatusBadRequest)
+			assertError(t, response, server.InvalidRankingErr)
+		})
+	})
+
+	t.Run("POST comment and reply to /thread/{id}/comments and GET returns the tree", func(t *testing.T) {
+		store := &spyStore{
+			threads: []server.Thread{{ID: 0, Content: "this is thread 1", User: "anna"}},
+		}
+		testServer := server.NewServer(server.AdaptThreadStore(store), NewSpyClientManager())
+		go testServer.StartWorkers()
+
+		response := httptest.NewRecorder()
+		testServer.ServeHTTP(response, newPOSTRequest("/thread/0/comments", commentPayload{Content: "first!", User: "bob"}))
+		assertStatus(t, response, http.StatusOK)
+
+		response = httptest.NewRecorder()
+		testServer.ServeHTTP(response, newPOSTRequest("/thread/0/comments", commentPayload{ParentID: 1, Content: "no, me", User: "karenina"}))
+		assertStatus(t, response, http.StatusOK)
+
+		want := server.Comments{
+			{ID: 1, ThreadID: 0, ParentID: 0, Depth: 0, Content: "first!", User: "bob"},
+			{ID: 2, ThreadID: 0, ParentID: 1, Depth: 1, Content: "no, me", User: "karenina"},
+		}
+
+		response = httptest.NewRecorder()
+		testServer.ServeHTTP(response, newGETRequest("/thread/0/comments"))
+		assertStatus(t, response, http.StatusOK)
+
+		var got server.Comments
+		json.NewDecoder(response.Body).Decode(&got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got comments %v want %v", got, want)
+		}
+	})
+
+	t.Run("Invalid POST requests to /thread/{id}/comments returns error", func(t *testing.T) {
+		store := &spyStore{
+			threads: []server.Thread{{ID: 0, Content: "this is thread 1", User: "anna"}},
+		}
+		testServer := server.NewServer(server.AdaptThreadStore(store), NewSpyClientManager())
+		testcase := []struct {
+			name    string
+			url     string
+			comment commentPayload
+			err     error
+			code    int
+		}{
+			{
+				name:    "Commenting on missing thread",
+				url:     "/thread/1/comments",
+				comment: commentPayload{Content: "hello?", User: "bob"},
+				err:     server.MissingThreadErr,
+				code:    http.StatusNotFound,
+			},
+			{
+				name:    "Commenting without content",
+				url:     "/thread/0/comments",
+				comment: commentPayload{User: "bob"},
+				err:     server.EmptyCommentErr,
+				code:    http.StatusBadRequest,
+			},
+			{
+				name:    "Commenting without a user",
+				url:     "/thread/0/comments",
+				comment: commentPayload{Content: "hello?"},
+				err:     server.MissingCommenterErr,
+				code:    http.StatusBadRequest,
+			},
+		}
+
+		for _, tc := range testcase {
+			t.Run(tc.name, func(t *testing.T) {
+				response := httptest.NewRecorder()
+
+				testServer.ServeHTTP(response, newPOSTRequest(tc.url, tc.comment))
+				assertStatus(t, response, tc.code)
+				assertError(t, response, tc.err)
+			})
+		}
+	})
+}
+
+func TestWebSocket(t *testing.T) {
+	threads := []server.Thread{
+		{
+			Content:        "What is the truth?",
+			User:           "Neo",
+			UpVotesCount:   0,
+			DownVotesCount: 0,
+		},
+		{
+			Content:        "There is no spoon",
+			User:           "Random kid",
+			UpVotesCount:   0,
+			DownVotesCount: 0,
+		},
+	}
+
+	testStore := &spyStore{threads}
+	threadServer := server.NewServer(server.AdaptThreadStore(testStore), NewSpyClientManager())
+	go threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws"
+	ws := MustDialWS(t, wsURL)
+
+	defer ws.Close()
+	defer testServer.Close()
+
+	var seq uint64
+	t.Run("Websocket request to /ws returns a snapshot of all threads inside.", func(t *testing.T) {
+		got := readEvent(t, ws)
+		seq = got.Seq
+		assertEvent(t, got, server.SnapshotEvent, seq)
+		assertThreads(t, unweigh(got.Threads), threads)
+	})
+
+	t.Run("Websocket send Threads to /ws received, saved by store and sent as thread_created events.", func(t *testing.T) {
+		firstThreadPayload := newThreadPayload("Excited about the Matrix", "Trinity")
+		threads = append([]server.Thread{threadPayloadToThread(firstThreadPayload)}, threads...)
+
+		ws.WriteJSON(firstThreadPayload)
+
+		got := readEvent(t, ws)
+		assertEvent(t, got, server.ThreadCreatedEvent, seq+1)
+		assertThreadExceptID(t, got.Thread.Thread, threads[0])
+
+		secondThreadPayload := newThreadPayload("I know kungfu", "Neo")
+		threads = append([]server.Thread{threadPayloadToThread(secondThreadPayload)}, threads...)
+		ws.WriteJSON(secondThreadPayload)
+
+		got = readEvent(t, ws)
+		assertEvent(t, got, server.ThreadCreatedEvent, seq+2)
+		assertThreadExceptID(t, got.Thread.Thread, threads[0])
+	})
+
+	t.Run("Websocket send Vote to /ws sends a thread_updated event to all clients.", func(t *testing.T) {
+		threads[2].UpVotesCount++
+		sendMessage(t, ws, server.VoteMessage, "vote-1", votePayload{ThreadID: 0, User: "Trinity", Value: 1})
+
+		got := readEvent(t, ws)
+		assertEvent(t, got, server.ThreadUpdatedEvent, seq+3)
+		assertThreadExceptID(t, got.Thread.Thread, threads[2])
+
+		ack := readEnvelope(t, ws)
+		assertEnvelope(t, ack, server.AckMessage, "vote-1")
+
+		var acked server.Thread
+		json.Unmarshal(ack.Payload, &acked)
+		assertThreadExceptID(t, acked, threads[2])
+	})
+
+	t.Run("Websocket send Comment to /ws broadcasts a comment_created event.", func(t *testing.T) {
+		sendMessage(t, ws, server.CommentMessage, "", commentPayload{ThreadID: 0, Content: "Follow the white rabbit", User: "Trinity"})
+
+		got := readEvent(t, ws)
+		assertEvent(t, got, server.CommentCreatedEvent, seq+4)
+
+		want := server.Comment{ID: 1, ThreadID: 0, Content: "Follow the white rabbit", User: "Trinity"}
+		if got.Comment == nil || !reflect.DeepEqual(*got.Comment, want) {
+			t.Errorf("got comment %v want %v", got.Comment, want)
+		}
+		threads[2].Comments = server.Comments{want}
+	})
+
+	t.Run("Websocket asking /ws for a snapshot receives every ranked thread.", func(t *testing.T) {
+		sendMessage(t, ws, server.SnapshotMessage, "", nil)
+
+		got := readEvent(t, ws)
+		assertEvent(t, got, server.SnapshotEvent, seq+4)
+		assertThreads(t, unweigh(got.Threads), threads)
+	})
+
+	t.Run("Websocket reconnecting to /ws with since replays only the missed events.", func(t *testing.T) {
+		resumed := MustDialWS(t, fmt.Sprintf("%s?since=%d", wsURL, seq+2))
+		defer resumed.Close()
+
+		assertEvent(t, readEvent(t, resumed), server.ThreadUpdatedEvent, seq+3)
+		assertEvent(t, readEvent(t, resumed), server.CommentCreatedEvent, seq+4)
+
+		sendMessage(t, resumed, server.ResumeMessage, "", map[string]uint64{"since": seq + 3})
+		assertEvent(t, readEvent(t, resumed), server.CommentCreatedEvent, seq+4)
+	})
+
+	t.Run("Websocket reconnecting to /ws with an unknown since receives a snapshot.", func(t *testing.T) {
+		for _, since := range []uint64{1, seq + 100} {
+			resumed := MustDialWS(t, fmt.Sprintf("%s?since=%d", wsURL, since))
+
+			got := readEvent(t, resumed)
+			assertEvent(t, got, server.SnapshotEvent, seq+4)
+			assertThreads(t, unweigh(got.Threads), threads)
+			resumed.Close()
+		}
+	})
+
+	t.Run("Websocket invalid messages to /ws get error replies and keep the connection open.", func(t *testing.T) {
+		testcases := []struct {
+			name    string
+			frame   string
+			id      string
+			code    string
+			message string
+		}{
+			{
+				name:    "unknown type",
+				frame:   `{"type": "dance", "id": "m-1"}`,
+				id:      "m-1",
+				code:    server.UnknownTypeCode,
+				message: `unknown message type "dance"`,
+			},
+			{
+				name:  "malformed JSON",
+				frame: `{"type": "vote", `,
+				code:  server.BadPayloadCode,
+			},
+			{
+				name:  "malformed payload",
+				frame: `{"type": "vote", "id": "m-2", "payload": "up"}`,
+				id:    "m-2",
+				code:  server.BadPayloadCode,
+			},
+			{
+				name:    "invalid vote",
+				frame:   `{"type": "vote", "id": "m-3", "payload": {"ThreadID": 0, "User": "Neo", "Value": 5}}`,
+				id:      "m-3",
+				code:    server.InvalidVoteCode,
+				message: server.InvalidVoteErr.Error(),
+			},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				ws.WriteMessage(websocket.TextMessage, []byte(tc.frame))
+
+				got := readEnvelope(t, ws)
+				assertEnvelope(t, got, server.ErrorMessage, tc.id)
+				assertMessageError(t, got, tc.code, tc.message)
+			})
+		}
+
+		sendMessage(t, ws, server.PingMessage, "still-there", nil)
+		assertEnvelope(t, readEnvelope(t, ws), server.PongMessage, "still-there")
+	})
+
+	t.Run("Websocket invalid threads to /ws get validation errors and can be fixed and retried.", func(t *testing.T) {
+		testcases := []struct {
+			name    string
+			message string
+			payload interface{}
+			want    server.MessageError
+		}{
+			{
+				name:    "thread without content",
+				message: server.ThreadMessage,
+				payload: newThreadPayload("", "Morpheus"),
+				want:    server.MessageError{Code: server.EmptyContentCode, Field: "Content", Message: server.EmptyContentErr.Error()},
+			},
+			{
+				name:    "thread without user",
+				message: server.ThreadMessage,
+				payload: newThreadPayload("Free your mind", ""),
+				want:    server.MessageError{Code: server.MissingUserCode, Field: "User", Message: server.MissingUserErr.Error()},
+			},
+			{
+				name:    "vote without user",
+				message: server.VoteMessage,
+				payload: votePayload{ThreadID: 0, Value: 1},
+				want:    server.MessageError{Code: server.MissingVoterCode, Field: "User", Message: server.MissingVoterErr.Error()},
+			},
+			{
+				name:    "comment on missing thread",
+				message: server.CommentMessage,
+				payload: commentPayload{ThreadID: 42, Content: "Anyone?", User: "Morpheus"},
+				want:    server.MessageError{Code: server.MissingThreadCode, Field: "ThreadID", Message: server.MissingThreadErr.Error()},
+			},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				sendMessage(t, ws, tc.message, tc.name, tc.payload)
+
+				got := readEnvelope(t, ws)
+				assertEnvelope(t, got, server.ErrorMessage, tc.name)
+
+				var e server.MessageError
+				json.Unmarshal(got.Payload, &e)
+				if e != tc.want {
+					t.Errorf("got error %+v want %+v", e, tc.want)
+				}
+			})
+		}
+
+		t.Run("legacy thread without content", func(t *testing.T) {
+			ws.WriteJSON(newThreadPayload("", "Morpheus"))
+
+			got := readEnvelope(t, ws)
+			assertEnvelope(t, got, server.ErrorMessage, "")
+			assertMessageError(t, got, server.EmptyContentCode, server.EmptyContentErr.Error())
+		})
+
+		sendMessage(t, ws, server.ThreadMessage, "", newThreadPayload("Free your mind", "Morpheus"))
+		got := readEvent(t, ws)
+		assertEvent(t, got, server.ThreadCreatedEvent, seq+5)
+		assertThreadExceptID(t, got.Thread.Thread, threadPayloadToThread(newThreadPayload("Free your mind", "Morpheus")))
+
+		t.Run("legacy thread with every field", func(t *testing.T) {
+			ws.WriteJSON(server.Thread{Content: "There is no spoon.", User: "Neo"})
+
+			got := readEvent(t, ws)
+			assertEvent(t, got, server.ThreadCreatedEvent, seq+6)
+			assertThreadExceptID(t, got.Thread.Thread, server.Thread{Content: "There is no spoon.", User: "Neo"})
+		})
+	})
+}
+
+func TestWebSocketManagement(t *testing.T) {
+	threads := []server.Thread{}
+
+	testStore := &spyStore{threads}
+	testWSManager := NewSpyClientManager()
+	threadServer := server.NewServer(server.AdaptThreadStore(testStore), testWSManager)
+
+	go threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws"
+	ws := MustDialWS(t, wsURL)
+
+	defer testServer.Close()
+
+	t.Run("Websocket gets removed when it is closed or not found.", func(t *testing.T) {
+		ws.Close()
+		time.Sleep(50 * time.Millisecond)
+		if len(testWSManager.GetClients()) != 0 {
+			t.Errorf("WS manager should have 0 sockets, but got %d", len(testWSManager.GetClients()))
+		}
+	})
+
+	t.Run("Websocket that stops reading is evicted as a slow consumer.", func(t *testing.T) {
+		config := server.DefaultSocketConfig
+		config.WriteWait, config.SendQueueSize = 50*time.Millisecond, 4
+		threadServer.SocketConfig = config
+
+		slow := MustDialWS(t, wsURL)
+		defer slow.Close()
+
+		evictions := expvar.Get("ws_slow_consumer_evictions").(*expvar.Int)
+		before := evictions.Value()
+
+		content := strings.Repeat("There is no spoon. ", 4096)
+		for i := 0; i < 1000 && evictions.Value() == before; i++ {
+			response := httptest.NewRecorder()
+			threadServer.ServeHTTP(response, newPOSTRequest("/thread", newThreadPayload(content, "Neo")))
+			assertStatus(t, response, http.StatusOK)
+		}
+
+		if evictions.Value() != before+1 {
+			t.Fatalf("wanted 1 slow consumer eviction, got %d", evictions.Value()-before)
+		}
+
+		fast := MustDialWS(t, wsURL)
+		defer fast.Close()
+		snapshot := readEvent(t, fast)
+		assertEvent(t, snapshot, server.SnapshotEvent, snapshot.Seq)
+
+		deadline := time.Now().Add(time.Second)
+		for len(testWSManager.GetClients()) != 1 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(testWSManager.GetClients()) != 1 {
+			t.Errorf("WS manager should only have the fast socket left, but got %d", len(testWSManager.GetClients()))
+		}
+	})
+}
+
+func TestSocketConfigDefaults(t *testing.T) {
+	threadServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+	threadServer.SocketConfig = server.SocketConfig{}
+	go threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	defer testServer.Close()
+	ws := MustDialWS(t, "ws"+strings.TrimPrefix(testServer.URL, "http")+"/ws")
+	defer ws.Close()
+	snapshot := readEvent(t, ws)
+
+	response := httptest.NewRecorder()
+	threadServer.ServeHTTP(response, newPOSTRequest("/thread", newThreadPayload("There is no spoon.", "Neo")))
+	assertStatus(t, response, http.StatusOK)
+	assertEvent(t, readEvent(t, ws), server.ThreadCreatedEvent, snapshot.Seq+1)
+}
+
+func TestWebSocketHeartbeat(t *testing.T) {
+	testWSManager := NewSpyClientManager()
+	threadServer := server.NewServer(server.AdaptThreadStore(&spyStore{}), testWSManager)
+	config := server.DefaultSocketConfig
+	config.PingInterval, config.PongWait = 20*time.Millisecond, 100*time.Millisecond
+	threadServer.SocketConfig = config
+
+	go threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws"
+
+	t.Run("Websocket that stops answering pings is removed.", func(t *testing.T) {
+		// The client answers pings only while it reads.
+		alive := MustDialWS(t, wsURL)
+		defer alive.Close()
+		go func() {
+			for {
+				if _, _, err := alive.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		idle := MustDialWS(t, wsURL)
+		defer idle.Close()
+
+		time.Sleep(300 * time.Millisecond)
+		if len(testWSManager.GetClients()) != 1 {
+			t.Fatalf("WS manager should only have the live socket left, but got %d", len(testWSManager.GetClients()))
+		}
+
+		idle.SetPingHandler(func(string) error { return nil })
+		idle.SetReadDeadline(time.Now().Add(time.Second))
+		var err error
+		for err == nil {
+			_, _, err = idle.ReadMessage()
+		}
+		if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("idle socket should be closed for a missed heartbeat, got %v", err)
+		}
+	})
+}
+
+func TestThreadEditing(t *testing.T) {
+	threadServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+	go threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	defer testServer.Close()
+	ws := MustDialWS(t, "ws"+strings.TrimPrefix(testServer.URL, "http")+"/ws")
+	defer ws.Close()
+	snapshot := readEvent(t, ws)
+
+	for _, payload := range []threadPayload{newThreadPayload("Free your mind", "Morpheus"), newThreadPayload("Dodge this", "Trinity")} {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newPOSTRequest("/thread", payload))
+		assertStatus(t, response, http.StatusOK)
+		readEvent(t, ws)
+	}
+
+	t.Run("PATCH /thread/{id} edits the content and sends a thread_updated event", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newPATCHRequest("/thread/1", threadPayload{Content: "Dodge this."}))
+		assertStatus(t, response, http.StatusOK)
+		assertThreadExceptID(t, getThreadFromBody(t, response.Body), server.Thread{Content: "Dodge this.", User: "Trinity"})
+
+		got := readEvent(t, ws)
+		assertEvent(t, got, server.ThreadUpdatedEvent, snapshot.Seq+3)
+		assertThreadExceptID(t, got.Thread.Thread, server.Thread{Content: "Dodge this.", User: "Trinity"})
+
+		response = httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newGETRequest("/thread/1"))
+		assertThreadExceptID(t, getThreadFromBody(t, response.Body), server.Thread{Content: "Dodge this.", User: "Trinity"})
+	})
+
+	t.Run("DELETE /thread/{id} removes the thread and sends a thread_deleted event", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newDELETERequest("/thread/0"))
+		assertStatus(t, response, http.StatusNoContent)
+
+		got := readEvent(t, ws)
+		assertEvent(t, got, server.ThreadDeletedEvent, snapshot.Seq+4)
+		if got.Thread == nil || got.Thread.ID != 0 || !got.Thread.Deleted {
+			t.Errorf("thread_deleted event should carry the tombstone of thread 0, got %+v", got.Thread)
+		}
+
+		response = httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newGETRequest("/thread"))
+		threads := getThreadsFromBody(t, response.Body)
+		if len(threads) != 1 || threads[0].ID != 1 {
+			t.Errorf("GET /thread should only return thread 1, got %v", threads)
+		}
+	})
+
+	t.Run("missing and deleted threads are not found", func(t *testing.T) {
+		testcases := []*http.Request{
+			newGETRequest("/thread/0"),
+			newPATCHRequest("/thread/0", threadPayload{Content: "Back again"}),
+			newDELETERequest("/thread/0"),
+			newPOSTRequest("/thread/0/vote", votePayload{User: "Neo", Value: 1}),
+			newGETRequest("/thread/7"),
+			newPATCHRequest("/thread/7", threadPayload{Content: "Who?"}),
+			newDELETERequest("/thread/7"),
+		}
+		for _, request := range testcases {
+			response := httptest.NewRecorder()
+			threadServer.ServeHTTP(response, request)
+			if response.Code != http.StatusNotFound {
+				t.Errorf("%s %s: got status %d want %d", request.Method, request.URL.Path, response.Code, http.StatusNotFound)
+			}
+		}
+	})
+
+	t.Run("PATCH without content is refused", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newPATCHRequest("/thread/1", threadPayload{}))
+		assertStatus(t, response, http.StatusBadRequest)
+	})
+
+	t.Run("stores without editing support answer 501", func(t *testing.T) {
+		adapted := server.NewServer(server.AdaptThreadStore(&spyStore{threads: []server.Thread{{Content: "Hi", User: "Anna"}}}), NewSpyClientManager())
+		for _, request := range []*http.Request{newPATCHRequest("/thread/0", threadPayload{Content: "Bye"}), newDELETERequest("/thread/0")} {
+			response := httptest.NewRecorder()
+			adapted.ServeHTTP(response, request)
+			assertStatus(t, response, http.StatusNotImplemented)
+		}
+	})
+}
+
+func TestThreadIDs(t *testing.T) {
+	threadServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+	go threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	defer testServer.Close()
+	ws := MustDialWS(t, "ws"+strings.TrimPrefix(testServer.URL, "http")+"/ws")
+	defer ws.Close()
+	readEvent(t, ws)
+
+	const posts = 20
+	var wg sync.WaitGroup
+	for i := 0; i < posts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response := httptest.NewRecorder()
+			threadServer.ServeHTTP(response, newPOSTRequest("/thread", newThreadPayload("There is no spoon.", "Neo")))
+		}()
+		sendMessage(t, ws, server.ThreadMessage, "", newThreadPayload("Free your mind", "Morpheus"))
+	}
+	wg.Wait()
+
+	ids := make(map[int]bool)
+	for len(ids) < 2*posts {
+		got := readEvent(t, ws)
+		if got.Type != server.ThreadCreatedEvent {
+			continue
+		}
+		if ids[got.Thread.ID] {
+			t.Fatalf("thread ID %d was given out twice", got.Thread.ID)
+		}
+		ids[got.Thread.ID] = true
+	}
+
+	response := httptest.NewRecorder()
+	threadServer.ServeHTTP(response, newDELETERequest(fmt.Sprintf("/thread/%d", 2*posts-1)))
+	assertStatus(t, response, http.StatusNoContent)
+
+	response = httptest.NewRecorder()
+	threadServer.ServeHTTP(response, newPOSTRequest("/thread", newThreadPayload("Dodge this", "Trinity")))
+	if got := getThreadFromBody(t, response.Body); got.ID != 2*posts {
+		t.Errorf("thread posted after a deletion got ID %d, want %d", got.ID, 2*posts)
+	}
+}
+
+func TestThreadQueries(t *testing.T) {
+	store := &server.MemStore{}
+	start := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, user := range []string{"Neo", "Trinity", "Neo", "Morpheus", "Neo"} {
+		store.SaveThread(context.Background(), server.Thread{Content: "Wake up.", User: user, CreatedAt: start.Add(time.Duration(i) * time.Hour)})
+	}
+	store.Vote(context.Background(), server.Vote{ThreadID: 2, User: "Trinity", Value: 1})
+	store.Vote(context.Background(), server.Vote{ThreadID: 4, User: "Trinity", Value: -1})
+	store.DeleteThread(context.Background(), 1)
+	threadServer := server.NewServer(store, NewSpyClientManager())
+
+	t.Run("filters without paging return a list", func(t *testing.T) {
+		testcases := []struct {
+			name  string
+			query string
+			want  []int
+		}{
+			{"everything", "", []int{0, 2, 3, 4}},
+			{"by user", "?user=Neo", []int{0, 2, 4}},
+			{"since", "?since=" + start.Add(2*time.Hour).Format(time.RFC3339), []int{2, 3, 4}},
+			{"by score", "?min_score=0", []int{0, 2, 3}},
+			{"combined", "?user=Neo&min_score=1", []int{2}},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				response := httptest.NewRecorder()
+				threadServer.ServeHTTP(response, newGETRequest("/thread"+tc.query))
+				assertStatus(t, response, http.StatusOK)
+				assertThreadIDs(t, getThreadsFromBody(t, response.Body), tc.want)
+			})
+		}
+	})
+
+	t.Run("limit and cursor page through the threads", func(t *testing.T) {
+		var got []server.Thread
+		pages := 0
+		path := "/thread?limit=2&user=Neo"
+		for {
+			response := httptest.NewRecorder()
+			threadServer.ServeHTTP(response, newGETRequest(path))
+			assertStatus(t, response, http.StatusOK)
+
+			var page server.WeightedThreadPage
+			if err := json.NewDecoder(response.Body).Decode(&page); err != nil {
+				t.Fatalf("Unable to parse response from server %q, %v", response.Body, err)
+			}
+			got = append(got, unweigh(page.Threads)...)
+			pages++
+			if page.NextCursor == "" {
+				break
+			}
+			path = "/thread?limit=2&user=Neo&cursor=" + page.NextCursor
+		}
+
+		assertThreadIDs(t, got, []int{0, 2, 4})
+		if pages != 2 {
+			t.Errorf("got %d pages, want 2", pages)
+		}
+	})
+
+	t.Run("invalid queries are refused", func(t *testing.T) {
+		testcases := []struct {
+			name  string
+			query string
+			err   error
+		}{
+			{"limit", "?limit=none", server.InvalidQueryErr},
+			{"negative limit", "?limit=-1", server.InvalidQueryErr},
+			{"since", "?since=yesterday", server.InvalidQueryErr},
+			{"min_score", "?min_score=high", server.InvalidQueryErr},
+			{"cursor", "?cursor=bogus", server.InvalidCursorErr},
+			{"sorted page", "?limit=2&sort=hot", server.PagedRankingErr},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				response := httptest.NewRecorder()
+				threadServer.ServeHTTP(response, newGETRequest("/thread"+tc.query))
+				assertStatus(t, response, http.StatusBadRequest)
+				assertError(t, response, tc.err)
+			})
+		}
+	})
+}
+
+func TestThreadSearch(t *testing.T) {
+	store := &server.MemStore{}
+	for _, thread := range []server.Thread{
+		{Content: "Free your mind.", User: "Morpheus"},
+		{Content: "There is no spoon.", User: "Spoon boy"},
+		{Content: "Mind the spoon, free spirits are free.", User: "Neo"},
+	} {
+		store.SaveThread(context.Background(), thread)
+	}
+	threadServer := server.NewServer(store, NewSpyClientManager())
+
+	search := func(t *testing.T, query string) []server.Thread {
+		t.Helper()
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newGETRequest("/thread/search?q="+url.QueryEscape(query)))
+		assertStatus(t, response, http.StatusOK)
+
+		var results server.SearchResults
+		if err := json.NewDecoder(response.Body).Decode(&results); err != nil {
+			t.Fatalf("Unable to parse response from server %q, %v", response.Body, err)
+		}
+		threads := make([]server.Thread, len(results))
+		for i, result := range results {
+			threads[i] = result.Thread
+		}
+		return threads
+	}
+
+	t.Run("finds threads saved before the server started, best match first", func(t *testing.T) {
+		testcases := []struct {
+			name  string
+			query string
+			want  []int
+		}{
+			{"term", "free", []int{2, 0}},
+			{"every term must match", "spoon free", []int{2}},
+			{"user", "neo", []int{2}},
+			{"user counts for more", "spoon", []int{1, 2}},
+			{"phrase", `"free your"`, []int{0}},
+			{"phrase in order only", `"your free"`, []int{}},
+			{"prefix", "spir*", []int{2}},
+			{"prefix matches whole terms too", "min*", []int{2, 0}},
+			{"case and punctuation", "SPOON.", []int{1, 2}},
+			{"nothing", "trinity", []int{}},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				assertThreadIDs(t, search(t, tc.query), tc.want)
+			})
+		}
+	})
+
+	t.Run("keeps up with new, edited and deleted threads", func(t *testing.T) {
 		response := httptest.NewRecorder()
-		store := &spyStore{}
-		testServer := server.NewServer(store, NewSpyClientManager())
+		threadServer.ServeHTTP(response, newPOSTRequest("/thread", newThreadPayload("Dodge this.", "Trinity")))
+		posted := getThreadFromBody(t, response.Body)
+		assertThreadIDs(t, search(t, "dodge"), []int{posted.ID})
 
-		testServer.ServeHTTP(response, request)
+		response = httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newPATCHRequest(fmt.Sprintf("/thread/%d", posted.ID), threadPayload{Content: "Trinity, help."}))
+		assertStatus(t, response, http.StatusOK)
+		assertThreadIDs(t, search(t, "dodge"), []int{})
+		assertThreadIDs(t, search(t, "help"), []int{posted.ID})
 
-		assertStatus(t, response, http.StatusBadRequest)
-		assertError(t, response, server.EmptyContentErr)
+		response = httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newDELETERequest("/thread/0"))
+		assertStatus(t, response, http.StatusNoContent)
+		assertThreadIDs(t, search(t, "free"), []int{2})
+	})
 
-		if len(store.threads) != 0 {
-			t.Errorf("Should not have stored bad thread, but it did.")
-		}
+	t.Run("empty queries are refused", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newGETRequest("/thread/search?q=%22*%22"))
+		assertStatus(t, response, http.StatusBadRequest)
+		assertError(t, response, server.EmptySearchErr)
 	})
+}
 
-	t.Run("Post thread with no user and receive an error", func(t *testing.T) {
-		testThread := newThreadPayload("this is thread 1", "")
+func TestCommunities(t *testing.T) {
+	store := &server.MemStore{}
+	store.SaveThread(context.Background(), server.Thread{Content: "Gophers unite.", User: "Rob", Community: "golang"})
+	store.SaveThread(context.Background(), server.Thread{Content: "Hello, everyone.", User: "Anna"})
+	threadServer := server.NewServer(store, NewSpyClientManager())
+	go threadServer.StartWorkers()
 
-		request := newPOSTRequest("/thread", testThread)
-		response := httptest.NewRecorder()
-		store := &spyStore{}
-		testServer := server.NewServer(store, NewSpyClientManager())
+	testServer := httptest.NewServer(threadServer)
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http")
+
+	golang := MustDialWS(t, wsURL+"/chat?community=golang")
+	defer golang.Close()
+	rust := MustDialWS(t, wsURL+"/chat?community=rust")
+	defer rust.Close()
+	everyone := MustDialWS(t, wsURL+"/chat")
+	defer everyone.Close()
+
+	var rustSeq uint64
+	t.Run("snapshots only hold the threads of the communities followed", func(t *testing.T) {
+		assertThreadIDs(t, unweigh(readEvent(t, golang).Threads), []int{0})
+		snapshot := readEvent(t, rust)
+		assertThreadIDs(t, unweigh(snapshot.Threads), []int{})
+		rustSeq = snapshot.Seq
+		assertThreadIDs(t, unweigh(readEvent(t, everyone).Threads), []int{0, 1})
+	})
 
-		testServer.ServeHTTP(response, request)
+	t.Run("POST /c/{community}/thread posts to the community and only its followers hear of it", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newPOSTRequest("/c/golang/thread", newThreadPayload("Generics, finally.", "Ian")))
+		assertStatus(t, response, http.StatusOK)
+		posted := getThreadFromBody(t, response.Body)
+		if posted.Community != "golang" {
+			t.Errorf("got community %q, want %q", posted.Community, "golang")
+		}
 
-		assertStatus(t, response, http.StatusBadRequest)
-		assertError(t, response, server.MissingUserErr)
+		sendMessage(t, everyone, server.ThreadMessage, "", server.Thread{Content: "Fearless.", User: "Ferris", Community: "rust"})
 
-		if len(store.threads) != 0 {
-			t.Errorf("Should not have stored bad thread, but it did.")
+		for _, ws := range []*websocket.Conn{golang, everyone} {
+			got := readEvent(t, ws)
+			if got.Type != server.ThreadCreatedEvent || got.Thread.ID != posted.ID {
+				t.Errorf("got %s event for thread %v, want %s for thread %d", got.Type, got.Thread, server.ThreadCreatedEvent, posted.ID)
+			}
+		}
+		assertCommunity(t, readEvent(t, everyone), "rust")
+		// rust is numbered apart, so the golang thread leaves no gap in what it sees.
+		got := readEvent(t, rust)
+		assertCommunity(t, got, "rust")
+		if got.Seq != rustSeq+1 {
+			t.Errorf("got event #%d after snapshot #%d, want consecutive events", got.Seq, rustSeq)
 		}
 	})
 
-	t.Run("GET request to /thread/0 returns first thread", func(t *testing.T) {
-		thread := threadPayloadToThread(newThreadPayload("this is thread 1", "anna"))
-		secondThread := threadPayloadToThread(newThreadPayload("this is thread 2", "karenina"))
+	t.Run("replays to scoped clients hold only the changes they follow", func(t *testing.T) {
+		resumed := MustDialWS(t, fmt.Sprintf("%s/chat?community=rust&since=%d", wsURL, rustSeq))
+		defer resumed.Close()
+		got := readEvent(t, resumed)
+		assertEvent(t, got, server.ThreadCreatedEvent, rustSeq+1)
+		assertCommunity(t, got, "rust")
 
-		store := &spyStore{
-			threads: []server.Thread{thread, secondThread},
-		}
-		testServer := server.NewServer(store, NewSpyClientManager())
+		sendMessage(t, resumed, server.PingMessage, "done", nil)
+		assertEnvelope(t, readEnvelope(t, resumed), server.PongMessage, "done")
+	})
 
-		request := newGETRequest("/thread/0")
-		response := httptest.NewRecorder()
+	later := time.Now().Add(6 * time.Hour)
+	t.Run("weights only go to the clients following their threads", func(t *testing.T) {
+		both := MustDialWS(t, wsURL+"/chat?community=rust&community=golang&community=rust")
+		defer both.Close()
+		assertThreadIDs(t, unweigh(readEvent(t, both).Threads), []int{3, 2, 0})
 
-		testServer.ServeHTTP(response, request)
+		if err := threadServer.RefreshWeights(later); err != nil {
+			t.Fatalf("unexpected error refreshing weights, %v", err)
+		}
+		testcases := []struct {
+			name string
+			ws   *websocket.Conn
+			want []int
+		}{
+			{"golang", golang, []int{0, 2}},
+			{"rust", rust, []int{3}},
+			{"golang and rust", both, []int{0, 2, 3}},
+			{"every community", everyone, []int{0, 1, 2, 3}},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				got := readEvent(t, tc.ws)
+				if got.Type != server.WeightsUpdatedEvent {
+					t.Fatalf("got %s event, want %s", got.Type, server.WeightsUpdatedEvent)
+				}
+				var ids []int
+				for id := range got.Weights {
+					ids = append(ids, id)
+				}
+				sort.Ints(ids)
+				if !reflect.DeepEqual(ids, tc.want) {
+					t.Errorf("got weights of threads %v, want %v", ids, tc.want)
+				}
+			})
+		}
+	})
 
-		d := getThreadFromBody(t, response.Body)
+	t.Run("weights are only sent when they change and are not replayed", func(t *testing.T) {
+		if err := threadServer.RefreshWeights(later.Add(time.Minute)); err != nil {
+			t.Fatalf("unexpected error refreshing weights, %v", err)
+		}
+		sendMessage(t, rust, server.PingMessage, "unchanged", nil)
+		assertEnvelope(t, readEnvelope(t, rust), server.PongMessage, "unchanged")
+
+		resumed := MustDialWS(t, fmt.Sprintf("%s/chat?community=rust&since=%d", wsURL, rustSeq))
+		defer resumed.Close()
+		assertEvent(t, readEvent(t, resumed), server.ThreadCreatedEvent, rustSeq+1)
+		sendMessage(t, resumed, server.PingMessage, "replayed", nil)
+		assertEnvelope(t, readEnvelope(t, resumed), server.PongMessage, "replayed")
+	})
 
-		assertThreadExceptID(t, d, thread)
+	t.Run("GET /c/{community}/thread lists the threads of the community", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newGETRequest("/c/golang/thread"))
+		assertStatus(t, response, http.StatusOK)
+		assertThreadIDs(t, getThreadsFromBody(t, response.Body), []int{0, 2})
 
-		request = newGETRequest("/thread/1")
 		response = httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newGETRequest("/thread"))
+		assertThreadIDs(t, getThreadsFromBody(t, response.Body), []int{0, 1, 2, 3})
+	})
 
-		testServer.ServeHTTP(response, request)
-
-		d = getThreadFromBody(t, response.Body)
+	t.Run("invalid communities are refused", func(t *testing.T) {
+		testcases := []struct {
+			name    string
+			request *http.Request
+			status  int
+		}{
+			{"in the path", newGETRequest("/c/Go%20lang/thread"), http.StatusBadRequest},
+			{"in a posted thread", newPOSTRequest("/thread", server.Thread{Content: "Hi", User: "Anna", Community: "../etc"}), http.StatusBadRequest},
+			{"to follow", newGETRequest("/chat?community=GOLANG"), http.StatusBadRequest},
+			{"unknown route", newGETRequest("/c/golang/chat"), http.StatusNotFound},
+		}
 
-		assertThreadExceptID(t, d, secondThread)
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				response := httptest.NewRecorder()
+				threadServer.ServeHTTP(response, tc.request)
+				assertStatus(t, response, tc.status)
+			})
+		}
 	})
+}
 
-	t.Run("Invalid GET requests to /thread/{id} returns error", func(t *testing.T) {
-
-		store := &spyStore{}
-		testServer := server.NewServer(store, NewSpyClientManager())
-		testcase := []struct {
-			name string
-			url  string
-			err  error
-			code int
+func TestStoreFailures(t *testing.T) {
+	t.Run("REST calls answer 500 when the store fails", func(t *testing.T) {
+		testcases := []struct {
+			name    string
+			store   *failingStore
+			request *http.Request
 		}{
-			{
-				name: "Getting from empty store",
-				url:  "/thread/0",
-				err:  server.MissingThreadErr,
-				code: http.StatusNotFound,
-			},
-			{
-				name: "Getting with string ID",
-				url:  "/thread/a",
-				err:  server.InvalidIDErr,
-				code: http.StatusBadRequest,
-			},
-			{
-				name: "Getting with negative ID",
-				url:  "/thread/-1",
-				err:  server.InvalidIDErr,
-				code: http.StatusBadRequest,
-			},
+			{"saving a thread", &failingStore{}, newPOSTRequest("/thread", newThreadPayload("There is no spoon.", "Neo"))},
+			{"voting", &failingStore{}, newPOSTRequest("/thread/0/vote", votePayload{User: "Neo", Value: 1})},
+			{"commenting", &failingStore{}, newPOSTRequest("/thread/0/comments", commentPayload{Content: "Whoa.", User: "Neo"})},
+			{"reading threads", &failingStore{failReads: true}, newGETRequest("/thread")},
+			{"reading comments", &failingStore{failReads: true}, newGETRequest("/thread/0/comments")},
 		}
 
-		for _, tc := range testcase {
+		for _, tc := range testcases {
 			t.Run(tc.name, func(t *testing.T) {
-				request := newGETRequest(tc.url)
+				testServer := server.NewServer(tc.store, NewSpyClientManager())
 				response := httptest.NewRecorder()
+				testServer.ServeHTTP(response, tc.request)
 
-				testServer.ServeHTTP(response, request)
-				assertStatus(t, response, tc.code)
-				assertError(t, response, tc.err)
+				assertStatus(t, response, http.StatusInternalServerError)
+				if got := strings.TrimSpace(response.Body.String()); got != server.StoreFailureErrMsg {
+					t.Errorf("got body %q, want %q", got, server.StoreFailureErrMsg)
+				}
 			})
 		}
+	})
+
+	t.Run("REST calls that end before the store answers are not store failures", func(t *testing.T) {
+		testServer := server.NewServer(&server.MemStore{}, NewSpyClientManager())
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		for _, path := range []string{"/thread", "/thread?community=golang", "/pair/notes/history"} {
+			response := httptest.NewRecorder()
+			testServer.ServeHTTP(response, newGETRequest(path).WithContext(ctx))
+			assertStatus(t, response, http.StatusServiceUnavailable)
+		}
+	})
 
+	t.Run("websocket messages get store_failure errors when the store fails", func(t *testing.T) {
+		threadServer := server.NewServer(&failingStore{}, NewSpyClientManager())
+		go threadServer.StartWorkers()
+
+		testServer := httptest.NewServer(threadServer)
+		defer testServer.Close()
+		ws := MustDialWS(t, "ws"+strings.TrimPrefix(testServer.URL, "http")+"/ws")
+		defer ws.Close()
+		readEvent(t, ws)
+
+		sendMessage(t, ws, server.ThreadMessage, "thread-1", newThreadPayload("There is no spoon.", "Neo"))
+		got := readEnvelope(t, ws)
+		assertEnvelope(t, got, server.ErrorMessage, "thread-1")
+		assertMessageError(t, got, server.StoreFailureCode, server.StoreFailureErrMsg)
+
+		sendMessage(t, ws, server.VoteMessage, "vote-1", votePayload{ThreadID: 0, User: "Neo", Value: 1})
+		got = readEnvelope(t, ws)
+		assertEnvelope(t, got, server.ErrorMessage, "vote-1")
+		assertMessageError(t, got, server.StoreFailureCode, server.StoreFailureErrMsg)
 	})
 }
 
-func TestWebSocket(t *testing.T) {
-	threads := []server.Thread{
-		{
-			Content:        "What is the truth?",
-			User:           "Neo",
-			UpVotesCount:   0,
-			DownVotesCount: 0,
-		},
-		{
-			Content:        "There is no spoon",
-			User:           "Random kid",
-			UpVotesCount:   0,
-			DownVotesCount: 0,
-		},
+func TestServerShutdown(t *testing.T) {
+	testStore := &spyStore{}
+	threadServer := server.NewServer(server.AdaptThreadStore(testStore), NewSpyClientManager())
+	threadServer.StartWorkers()
+
+	testServer := httptest.NewServer(threadServer)
+	defer testServer.Close()
+	ws := MustDialWS(t, "ws"+strings.TrimPrefix(testServer.URL, "http")+"/ws")
+	defer ws.Close()
+	snapshot := readEvent(t, ws)
+	assertEvent(t, snapshot, server.SnapshotEvent, snapshot.Seq)
+
+	const threads = 5
+	for i := 0; i < threads; i++ {
+		sendMessage(t, ws, server.ThreadMessage, fmt.Sprintf("c-%d", i), newThreadPayload("There is no spoon.", "Neo"))
 	}
 
-	testStore := &spyStore{threads}
-	threadServer := server.NewServer(testStore, NewSpyClientManager())
-	go threadServer.StartWorkers()
+	var frame struct {
+		Type string `json:"type"`
+	}
+	counts := make(map[string]int)
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	for counts[server.AckMessage] < threads {
+		if err := ws.ReadJSON(&frame); err != nil {
+			t.Fatalf("could not read acks from websocket, %v", err)
+		}
+		counts[frame.Type]++
+	}
 
-	testServer := httptest.NewServer(threadServer)
-	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws"
-	ws := MustDialWS(t, wsURL)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := threadServer.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed, %v", err)
+	}
 
-	defer ws.Close()
-	defer testServer.Close()
-	t.Run("Websocket request to /ws returns list all threads inside.", func(t *testing.T) {
-		var got []server.Thread
-		ws.ReadJSON(&got)
-		assertThreads(t, got, threads)
+	t.Run("queued threads are saved and sent before the socket goes away", func(t *testing.T) {
+		var err error
+		for err == nil {
+			if err = ws.ReadJSON(&frame); err == nil {
+				counts[frame.Type]++
+			}
+		}
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("socket should be closed as going away, got %v", err)
+		}
+		if counts[server.ThreadCreatedEvent] != threads {
+			t.Errorf("got %d thread_created events, want %d", counts[server.ThreadCreatedEvent], threads)
+		}
+		if len(testStore.threads) != threads {
+			t.Errorf("got %d saved threads, want %d", len(testStore.threads), threads)
+		}
+	})
+
+	t.Run("new threads are refused", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		threadServer.ServeHTTP(response, newPOSTRequest("/thread", newThreadPayload("There is no spoon.", "Neo")))
+		assertStatus(t, response, http.StatusServiceUnavailable)
 
+		if err := threadServer.Shutdown(ctx); err != server.ServerClosedErr {
+			t.Errorf("second shutdown should fail with %v, got %v", server.ServerClosedErr, err)
+		}
 	})
+}
 
-	t.Run("Websocket send Threads to /ws received and saved by store.", func(t *testing.T) {
-		firstThreadPayload := newThreadPayload("Excited about the Matrix", "Trinity")
-		threads = append(threads, threadPayloadToThread(firstThreadPayload))
+func readEvent(t testing.TB, ws *websocket.Conn) server.Event {
+	t.Helper()
+	var e server.Event
 
-		ws.WriteJSON(firstThreadPayload)
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if err := ws.ReadJSON(&e); err != nil {
+		t.Fatalf("could not read event from websocket, %v", err)
+	}
+	return e
+}
 
-		var got []server.Thread
-		ws.ReadJSON(&got)
-		assertThreads(t, got, threads)
+func assertCommunity(t testing.TB, got server.Event, want string) {
+	t.Helper()
+	if got.Thread == nil || got.Thread.Community != want {
+		t.Errorf("got %s event for thread %v, want a thread of %q", got.Type, got.Thread, want)
+	}
+}
 
-		secondThreadPayload := newThreadPayload("I know kungfu", "Neo")
-		threads = append(threads, threadPayloadToThread(secondThreadPayload))
-		ws.WriteJSON(secondThreadPayload)
+func assertEvent(t testing.TB, got server.Event, eventType string, seq uint64) {
+	t.Helper()
+	if got.Type != eventType || got.Seq != seq {
+		t.Errorf("got %s event #%d, want %s event #%d", got.Type, got.Seq, eventType, seq)
+	}
+	if (eventType == server.ThreadCreatedEvent || eventType == server.ThreadUpdatedEvent) && got.Thread == nil {
+		t.Fatalf("%s event is missing its thread", eventType)
+	}
+}
 
-		ws.ReadJSON(&got)
-		assertThreads(t, got, threads)
-	})
+func sendMessage(t testing.TB, ws *websocket.Conn, messageType, id string, payload interface{}) {
+	t.Helper()
+	env := server.Envelope{Type: messageType, ID: id}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatalf("could not encode %s payload, %v", messageType, err)
+		}
+		env.Payload = raw
+	}
+
+	if err := ws.WriteJSON(env); err != nil {
+		t.Fatalf("could not send %s message, %v", messageType, err)
+	}
 }
 
-func TestWebSocketManagement(t *testing.T) {
-	threads := []server.Thread{}
+func readEnvelope(t testing.TB, ws *websocket.Conn) server.Envelope {
+	t.Helper()
+	var env server.Envelope
 
-	testStore := &spyStore{threads}
-	testWSManager := NewSpyClientManager()
-	threadServer := server.NewServer(testStore, testWSManager)
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if err := ws.ReadJSON(&env); err != nil {
+		t.Fatalf("could not read message from websocket, %v", err)
+	}
+	return env
+}
 
-	go threadServer.StartWorkers()
+func assertEnvelope(t testing.TB, got server.Envelope, messageType, id string) {
+	t.Helper()
+	if got.Type != messageType || got.ID != id {
+		t.Errorf("got %s message %q, want %s message %q", got.Type, got.ID, messageType, id)
+	}
+}
 
-	testServer := httptest.NewServer(threadServer)
-	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws"
-	ws := MustDialWS(t, wsURL)
+// assertMessageError checks the code of an error message, and its text unless message is empty.
+func assertMessageError(t testing.TB, got server.Envelope, code, message string) {
+	t.Helper()
+	var e server.MessageError
+	if err := json.Unmarshal(got.Payload, &e); err != nil {
+		t.Fatalf("could not decode error payload %s, %v", got.Payload, err)
+	}
 
-	defer testServer.Close()
+	if e.Code != code || (message != "" && e.Message != message) {
+		t.Errorf("got error %q (%s), want %q (%s)", e.Message, e.Code, message, code)
+	}
+}
 
-	t.Run("Websocket gets removed when it is closed or not found.", func(t *testing.T) {
-		ws.Close()
-		time.Sleep(50 * time.Millisecond)
-		if len(testWSManager.GetClients()) != 0 {
-			t.Errorf("WS manager should have 0 sockets, but got %d", len(testWSManager.GetClients()))
-		}
-	})
+func unweigh(weighted server.WeightedThreads) []server.Thread {
+	threads := make([]server.Thread, len(weighted))
+	for i, w := range weighted {
+		threads[i] = w.Thread
+	}
+	return threads
 }
 
 func newGETRequest(path string) *http.Request {
@@ -255,13 +1502,31 @@ func newGETRequest(path string) *http.Request {
 }
 
 func newPOSTRequest(path string, data interface{}) *http.Request {
+	return newJSONRequest(http.MethodPost, path, data)
+}
+
+func newPATCHRequest(path string, data interface{}) *http.Request {
+	return newJSONRequest(http.MethodPatch, path, data)
+}
+
+func newDELETERequest(path string) *http.Request {
+	request, _ := http.NewRequest(http.MethodDelete, path, nil)
+	return request
+}
+
+func newOPTIONSRequest(path string) *http.Request {
+	request, _ := http.NewRequest(http.MethodOptions, path, nil)
+	return request
+}
+
+func newJSONRequest(method, path string, data interface{}) *http.Request {
 	payloadBuf := new(bytes.Buffer)
 	err := json.NewEncoder(payloadBuf).Encode(data)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	request, _ := http.NewRequest(http.MethodPost, path, payloadBuf)
+	request, _ := http.NewRequest(method, path, payloadBuf)
 	request.Header.Set("Content-Type", server.JSONContentType)
 
 	return request
@@ -304,22 +1569,34 @@ func assertThreads(t testing.TB, got, want []server.Thread) {
 	}
 }
 
+// assertThreadExceptID compares every field the client controls, skipping the ones the server assigns.
 func assertThreadExceptID(t testing.TB, got, want server.Thread) {
 	w := reflect.ValueOf(want)
 	g := reflect.ValueOf(got)
 
 	for i := 0; i < w.NumField(); i++ {
 		fieldName := w.Type().Field(i).Name
-		if fieldName == "ID" {
+		if fieldName == "ID" || fieldName == "CreatedAt" {
 			continue
 		}
 
-		if g.Field(i).Interface() != w.Field(i).Interface() {
+		if !reflect.DeepEqual(g.Field(i).Interface(), w.Field(i).Interface()) {
 			t.Errorf("got %v want %v", got, want)
 		}
 	}
 }
 
+func assertThreadIDs(t testing.TB, got []server.Thread, want []int) {
+	t.Helper()
+	ids := make([]int, len(got))
+	for i, thread := range got {
+		ids[i] = thread.ID
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("got threads %v, want %v", ids, want)
+	}
+}
+
 func getThreadFromBody(t testing.TB, r io.Reader) server.Thread {
 	t.Helper()
 
@@ -358,6 +1635,19 @@ type threadPayload struct {
 	User    string
 }
 
+type commentPayload struct {
+	ThreadID int `json:",omitempty"`
+	ParentID int `json:",omitempty"`
+	Content  string
+	User     string
+}
+
+type votePayload struct {
+	ThreadID int `json:",omitempty"`
+	User     string
+	Value    int
+}
+
 type spyStore struct {
 	threads server.Threads
 }
@@ -370,19 +1660,53 @@ func (s *spyStore) GetThreads() server.Threads {
 	return s.threads
 }
 
-type spyClientManager struct {
-	server.ClientManager
+func (s *spyStore) Vote(vote server.Vote) (server.Thread, error) {
+	for i := range s.threads {
+		if s.threads[i].ID != vote.ThreadID {
+			continue
+		}
+		if vote.Value == 1 {
+			s.threads[i].UpVotesCount++
+		} else {
+			s.threads[i].DownVotesCount++
+		}
+		return s.threads[i], nil
+	}
+	return server.Thread{}, server.MissingThreadErr
+}
+
+func (s *spyStore) SaveComment(comment server.Comment) (server.Comment, error) {
+	for i := range s.threads {
+		if s.threads[i].ID != comment.ThreadID {
+			continue
+		}
+		comment.ID = len(s.threads[i].Comments) + 1
+		for _, parent := range s.threads[i].Comments {
+			if parent.ID == comment.ParentID {
+				comment.Depth = parent.Depth + 1
+			}
+		}
+		s.threads[i].Comments = append(s.threads[i].Comments, comment)
+		return comment, nil
+	}
+	return server.Comment{}, server.MissingThreadErr
 }
 
-func (s spyClientManager) GetClients() (clients []*server.ClientWS) {
-	for c := range s.Clients {
-		clients = append(clients, c)
+func (s *spyStore) GetComments(threadID int) (server.Comments, error) {
+	for _, thread := range s.threads {
+		if thread.ID == threadID {
+			return thread.Comments, nil
+		}
 	}
-	return
+	return nil, server.MissingThreadErr
+}
+
+type spyClientManager struct {
+	*server.ClientManager
 }
 
 func NewSpyClientManager() *spyClientManager {
-	return &spyClientManager{*server.NewClientManager()}
+	return &spyClientManager{server.NewClientManager()}
 }
 
 func MustDialWS(t *testing.T, url string) *websocket.Conn {
@@ -395,3 +1719,41 @@ func MustDialWS(t *testing.T, url string) *websocket.Conn {
 	}
 	return ws
 }
+
+var errDiskFull = errors.New("no space left on device")
+
+// failingStore fails every write, and every read too when failReads is set.
+type failingStore struct {
+	server.MemStore
+	failReads bool
+}
+
+func (s *failingStore) SaveThread(ctx context.Context, thread server.Thread) (server.Thread, error) {
+	return server.Thread{}, errDiskFull
+}
+
+func (s *failingStore) GetThreads(ctx context.Context) (server.Threads, error) {
+	if s.failReads {
+		return nil, errDiskFull
+	}
+	return s.MemStore.GetThreads(ctx)
+}
+
+func (s *failingStore) QueryThreads(ctx context.Context, query server.ThreadQuery) (server.ThreadPage, error) {
+	if s.failReads {
+		return server.ThreadPage{}, errDiskFull
+	}
+	return s.MemStore.QueryThreads(ctx, query)
+}
+
+func (s *failingStore) Vote(ctx context.Context, vote server.Vote) (server.Thread, error) {
+	return server.Thread{}, errDiskFull
+}
+
+func (s *failingStore) SaveComment(ctx context.Context, comment server.Comment) (server.Comment, error) {
+	return server.Comment{}, errDiskFull
+}
+
+func (s *failingStore) GetComments(ctx context.Context, threadID int) (server.Comments, error) {
+	return nil, errDiskFull
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// StoreError is a failure of the ThreadStore itself, rather than a problem with the request.
+// Clients are told to try again, while the cause is only logged.
+type StoreError struct {
+	Err error
+}
+
+func (e StoreError) Error() string {
+	return fmt.Sprintf("thread store failed, %v", e.Err)
+}
+
+func (e StoreError) Unwrap() error {
+	return e.Err
+}
+
+// storeFailure wraps err from the store in a StoreError, unless it is nil, one of the errors
+// a store uses to report a request it cannot serve, or the end of the request's context.
+func storeFailure(err error) error {
+	switch err {
+	case nil, MissingThreadErr, MissingCommentErr, UnsupportedErr, InvalidCursorErr:
+		return err
+	}
+	if contextEnded(err) {
+		return err
+	}
+	log.Printf("Thread store failed, %v", err)
+	return StoreError{Err: err}
+}
+
+// contextEnded reports whether err is a store giving up because the request was cancelled or
+// ran out of time, which says nothing about the store itself.
+func contextEnded(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// AdaptThreadStore lets a store written against the original ThreadStore interface serve as a
+// ThreadStoreV2. Calls are refused once ctx is done; otherwise they cannot fail where the
+// original interface has no error to return. Threads are looked up by scanning GetThreads,
+// and cannot be edited or deleted: UpdateThread and DeleteThread fail with UnsupportedErr.
+// New threads get the ID after the highest one in GetThreads, and queries filter all of them.
+func AdaptThreadStore(store ThreadStore) ThreadStoreV2 {
+	return &threadStoreAdapter{store: store}
+}
+
+type threadStoreAdapter struct {
+	mu    sync.Mutex // Serialises SaveThread, so that two threads never get the same ID.
+	store ThreadStore
+}
+
+func (a *threadStoreAdapter) SaveThread(ctx context.Context, thread Thread) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	thread.ID = a.store.GetThreads().nextID()
+	a.store.SaveThread(thread)
+	return thread, nil
+}
+
+func (a *threadStoreAdapter) GetThreads(ctx context.Context) (Threads, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.store.GetThreads(), nil
+}
+
+func (a *threadStoreAdapter) QueryThreads(ctx context.Context, query ThreadQuery) (ThreadPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ThreadPage{}, err
+	}
+	return a.store.GetThreads().query(query, nil)
+}
+
+func (a *threadStoreAdapter) GetThreadByID(ctx context.Context, id int) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	return a.store.GetThreads().byID(id)
+}
+
+func (a *threadStoreAdapter) UpdateThread(ctx context.Context, thread Thread) (Thread, error) {
+	return Thread{}, UnsupportedErr
+}
+
+func (a *threadStoreAdapter) DeleteThread(ctx context.Context, id int) (Thread, error) {
+	return Thread{}, UnsupportedErr
+}
+
+func (a *threadStoreAdapter) Vote(ctx context.Context, vote Vote) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	return a.store.Vote(vote)
+}
+
+func (a *threadStoreAdapter) SaveComment(ctx context.Context, comment Comment) (Comment, error) {
+	if err := ctx.Err(); err != nil {
+		return Comment{}, err
+	}
+	return a.store.SaveComment(comment)
+}
+
+func (a *threadStoreAdapter) GetComments(ctx context.Context, threadID int) (Comments, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.store.GetComments(threadID)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"time"
 )
 
 type Threads []Thread
@@ -11,8 +12,34 @@ type Thread struct {
 	ID             int
 	Content        string
 	User           string
+	Community      string `json:",omitempty"` // Empty for threads outside any community.
 	UpVotesCount   int
 	DownVotesCount int
+	Voters         map[string]int `json:"-"` // User to the Value of their current vote; kept private, see storedThread.
+	Comments       Comments       `json:",omitempty"`
+	CreatedAt      time.Time
+	Deleted        bool `json:",omitempty"` // Deleted threads are kept, emptied, so that their ID is never reused.
+}
+
+// Comments hold a thread's comment tree in creation order; the tree is rebuilt from ParentID.
+type Comments []Comment
+type Comment struct {
+	ID             int // Starts at 1 within each thread.
+	ThreadID       int
+	ParentID       int // 0 for a top-level comment.
+	Depth          int
+	Content        string
+	User           string
+	UpVotesCount   int
+	DownVotesCount int
+	Voters         map[string]int `json:"-"`
+}
+
+type Vote struct {
+	ThreadID  int
+	CommentID int `json:",omitempty"` // Set to vote on a comment instead of the thread.
+	User      string
+	Value     int // 1 for an upvote, -1 for a downvote, 0 to retract.
 }
 
 func GetThreadFromReader(rdr io.Reader) (Thread, error) {
@@ -32,3 +59,284 @@ func GetThreadsFromReader(rdr io.Reader) (Threads, error) {
 	}
 	return d, err
 }
+
+func GetCommentFromReader(rdr io.Reader) (Comment, error) {
+	var c Comment
+	err := json.NewDecoder(rdr).Decode(&c)
+	if err != nil {
+		err = fmt.Errorf("problem parsing comment, %v", err)
+	}
+	return c, err
+}
+
+func GetVoteFromReader(rdr io.Reader) (Vote, error) {
+	var v Vote
+	err := json.NewDecoder(rdr).Decode(&v)
+	if err != nil {
+		err = fmt.Errorf("problem parsing vote, %v", err)
+	}
+	return v, err
+}
+
+// indexOf returns the position of thread id, or -1 when it does not exist or was deleted.
+func (ts Threads) indexOf(id int) int {
+	for i, t := range ts {
+		if t.ID == id && !t.Deleted {
+			return i
+		}
+	}
+	return -1
+}
+
+func (cs Comments) indexOf(id int) int {
+	for i, c := range cs {
+		if c.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// storedThread is a thread as stores write it, with who voted on it and on its comments,
+// which API payloads leave out. It reads and writes the same JSON as Thread did before votes
+// were made private, so existing databases load unchanged.
+type storedThread struct {
+	Thread
+	Voters   map[string]int  `json:",omitempty"`
+	Comments []storedComment `json:",omitempty"`
+}
+
+type storedComment struct {
+	Comment
+	Voters map[string]int `json:",omitempty"`
+}
+
+func storeThread(t Thread) storedThread {
+	stored := storedThread{Thread: t, Voters: t.Voters}
+	for _, c := range t.Comments {
+		stored.Comments = append(stored.Comments, storedComment{Comment: c, Voters: c.Voters})
+	}
+	return stored
+}
+
+func (s storedThread) thread() Thread {
+	t := s.Thread
+	t.Voters, t.Comments = s.Voters, nil
+	for _, c := range s.Comments {
+		c.Comment.Voters = c.Voters
+		t.Comments = append(t.Comments, c.Comment)
+	}
+	return t
+}
+
+func storeThreads(ts Threads) []storedThread {
+	stored := make([]storedThread, len(ts))
+	for i, t := range ts {
+		stored[i] = storeThread(t)
+	}
+	return stored
+}
+
+func readStoredThreads(rdr io.Reader) (Threads, error) {
+	var stored []storedThread
+	if err := json.NewDecoder(rdr).Decode(&stored); err != nil {
+		return nil, fmt.Errorf("problem parsing thread, %v", err)
+	}
+	threads := make(Threads, len(stored))
+	for i, s := range stored {
+		threads[i] = s.thread()
+	}
+	return threads, nil
+}
+
+func (t Thread) clone() Thread {
+	t.Voters = cloneVoters(t.Voters)
+	if t.Comments != nil {
+		comments := make(Comments, len(t.Comments))
+		for i, c := range t.Comments {
+			c.Voters = cloneVoters(c.Voters)
+			comments[i] = c
+		}
+		t.Comments = comments
+	}
+	return t
+}
+
+func (ts Threads) clone() Threads {
+	c := make(Threads, len(ts))
+	for i, t := range ts {
+		c[i] = t.clone()
+	}
+	return c
+}
+
+// nextID returns the ID after the highest one ever used, deleted threads included.
+func (ts Threads) nextID() int {
+	next := 0
+	for _, t := range ts {
+		if t.ID >= next {
+			next = t.ID + 1
+		}
+	}
+	return next
+}
+
+// repairIDs gives every thread that shares its ID with an earlier one the next free ID, and
+// returns how many it renumbered. Threads saved before the store allocated IDs could share one.
+func (ts Threads) repairIDs() int {
+	next := ts.nextID()
+	seen := make(map[int]bool, len(ts))
+	repaired := 0
+
+	for i := range ts {
+		if seen[ts[i].ID] {
+			ts[i].ID = next
+			next++
+			for j := range ts[i].Comments {
+				ts[i].Comments[j].ThreadID = ts[i].ID
+			}
+			repaired++
+		}
+		seen[ts[i].ID] = true
+	}
+	return repaired
+}
+
+// live returns a copy of the threads that have not been deleted.
+func (ts Threads) live() Threads {
+	c := make(Threads, 0, len(ts))
+	for _, t := range ts {
+		if !t.Deleted {
+			c = append(c, t.clone())
+		}
+	}
+	return c
+}
+
+func (ts Threads) byID(id int) (Thread, error) {
+	i := ts.position(id)
+	if i < 0 || ts[i].Deleted {
+		return Thread{}, MissingThreadErr
+	}
+	return ts[i].clone(), nil
+}
+
+// edit replaces the content of thread update.ID, keeping its votes, comments, user and
+// creation time, and returns a copy of the edited thread.
+func (ts Threads) edit(update Thread) (Thread, error) {
+	i := ts.indexOf(update.ID)
+	if i < 0 {
+		return Thread{}, MissingThreadErr
+	}
+	ts[i].Content = update.Content
+	return ts[i].clone(), nil
+}
+
+// remove turns thread id into an empty tombstone and returns a copy of it.
+func (ts Threads) remove(id int) (Thread, error) {
+	i := ts.indexOf(id)
+	if i < 0 {
+		return Thread{}, MissingThreadErr
+	}
+	ts[i] = Thread{ID: id, User: ts[i].User, Community: ts[i].Community, CreatedAt: ts[i].CreatedAt, Deleted: true}
+	return ts[i], nil
+}
+
+func cloneVoters(voters map[string]int) map[string]int {
+	if voters == nil {
+		return nil
+	}
+	c := make(map[string]int, len(voters))
+	for user, value := range voters {
+		c[user] = value
+	}
+	return c
+}
+
+// vote applies v to the matching thread (or comment) in place and returns a copy of the updated thread.
+// Each user holds at most one vote per thread: repeating a vote is a no-op, voting the other
+// way moves the vote across and a Value of 0 retracts it.
+func (ts Threads) vote(v Vote) (Thread, error) {
+	i := ts.indexOf(v.ThreadID)
+	if i < 0 {
+		return Thread{}, MissingThreadErr
+	}
+	t := &ts[i]
+
+	if v.CommentID == 0 {
+		applyVote(&t.UpVotesCount, &t.DownVotesCount, &t.Voters, v)
+		return t.clone(), nil
+	}
+
+	j := t.Comments.indexOf(v.CommentID)
+	if j < 0 {
+		return Thread{}, MissingCommentErr
+	}
+	c := &t.Comments[j]
+	applyVote(&c.UpVotesCount, &c.DownVotesCount, &c.Voters, v)
+
+	return t.clone(), nil
+}
+
+func applyVote(up, down *int, voters *map[string]int, v Vote) {
+	previous := (*voters)[v.User]
+	if previous == v.Value {
+		return
+	}
+
+	count := func(value, delta int) {
+		switch value {
+		case 1:
+			*up += delta
+		case -1:
+			*down += delta
+		}
+	}
+	count(previous, -1)
+	count(v.Value, 1)
+
+	if v.Value == 0 {
+		delete(*voters, v.User)
+		return
+	}
+	if *voters == nil {
+		*voters = make(map[string]int)
+	}
+	(*voters)[v.User] = v.Value
+}
+
+// addComment appends c to its thread's comment tree, assigning its ID and depth.
+func (ts Threads) addComment(c Comment) (Comment, error) {
+	i := ts.indexOf(c.ThreadID)
+	if i < 0 {
+		return Comment{}, MissingThreadErr
+	}
+	t := &ts[i]
+
+	c.Depth = 0
+	if c.ParentID != 0 {
+		j := t.Comments.indexOf(c.ParentID)
+		if j < 0 {
+			return Comment{}, MissingCommentErr
+		}
+		c.Depth = t.Comments[j].Depth + 1
+	}
+
+	c.ID = len(t.Comments) + 1
+	c.UpVotesCount, c.DownVotesCount, c.Voters = 0, 0, nil
+	t.Comments = append(t.Comments, c)
+
+	return c, nil
+}
+
+func (ts Threads) comments(threadID int) (Comments, error) {
+	i := ts.indexOf(threadID)
+	if i < 0 {
+		return nil, MissingThreadErr
+	}
+	comments := ts[i].clone().Comments
+	if comments == nil {
+		comments = Comments{}
+	}
+	return comments, nil
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	DefaultWALCompactionThreshold = 1000
+	walExtension                  = ".wal"
+	walPut                        = "put"
+)
+
+// walRecord is one line of the write-ahead log. A put holds the whole thread as it is after
+// the change, so replaying a record twice does no harm.
+type walRecord struct {
+	Op     string       `json:"op"`
+	Thread storedThread `json:"thread"`
+}
+
+// WALStore keeps threads in memory and persists each change by appending one record to a
+// write-ahead log, so a write costs the size of one thread instead of the whole database.
+// On start the log is replayed over the last snapshot, which uses the threads.db.json array
+// format; every compactEvery records the threads are written to a new snapshot and the log
+// is emptied.
+type WALStore struct {
+	mu           sync.RWMutex
+	threads      Threads
+	snapshotPath string
+	log          *os.File
+	records      int
+	compactEvery int
+	nextID       int
+	communities  communityIndex
+}
+
+// NewWALStoreFromPath opens the store with its snapshot at path and its log at path.wal,
+// creating them when missing. An existing flat-file database at path is read as the snapshot.
+// The returned func compacts and closes the store, leaving a snapshot the flat-file store can read.
+func NewWALStoreFromPath(path string, compactEvery int) (*WALStore, func(), error) {
+	if err := removeTempFiles(path); err != nil {
+		return nil, nil, err
+	}
+
+	threads, err := readSnapshot(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	repaired := threads.repairIDs()
+
+	logFile, err := os.OpenFile(path+walExtension, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error opening %s file, %v", path+walExtension, err)
+	}
+
+	s := &WALStore{threads: threads, snapshotPath: path, log: logFile, compactEvery: compactEvery}
+	if err := s.replay(); err != nil {
+		logFile.Close()
+		return nil, nil, err
+	}
+	if repaired > 0 {
+		log.Printf("Gave %d threads in %s a new ID, as they shared theirs with another thread.", repaired, path)
+		if err := s.compact(); err != nil {
+			logFile.Close()
+			return nil, nil, err
+		}
+	}
+	s.nextID = s.threads.nextID()
+	s.communities = indexCommunities(s.threads)
+
+	return s, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.compact(); err != nil {
+			log.Printf("Unable to compact %s, %v", s.log.Name(), err)
+		}
+		s.log.Close()
+	}, nil
+}
+
+func readSnapshot(path string) (Threads, error) {
+	threads, err := readThreadsFile(path)
+	if err == missingDBErr {
+		return Threads{}, nil
+	}
+	return threads, err
+}
+
+// replay applies every record in the log. A final record without its newline was cut short
+// by a crash before it was synced, so it is dropped rather than treated as corruption.
+func (s *WALStore) replay() error {
+	reader := bufio.NewReader(s.log)
+	var offset int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) == 0 {
+				return nil
+			}
+			log.Printf("Dropping incomplete record at byte %d of %s.", offset, s.log.Name())
+			return s.log.Truncate(offset)
+		}
+		if err != nil {
+			return fmt.Errorf("problem reading %s, %v", s.log.Name(), err)
+		}
+
+		var r walRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("corrupt record at byte %d of %s, %v", offset, s.log.Name(), err)
+		}
+		s.apply(r)
+		offset += int64(len(line))
+		s.records++
+	}
+}
+
+func (s *WALStore) apply(r walRecord) {
+	switch r.Op {
+	case walPut:
+		// Tombstones included, so that replaying a deletion the snapshot already holds does
+		// not add the thread a second time.
+		t := r.Thread.thread()
+		if i := s.threads.position(t.ID); i >= 0 {
+			s.threads[i] = t
+			return
+		}
+		s.threads = append(s.threads, t)
+	}
+}
+
+// append must be called with mu held. It returns once the record is synced to disk.
+func (s *WALStore) append(t Thread) error {
+	line, err := json.Marshal(walRecord{Op: walPut, Thread: storeThread(t)})
+	if err != nil {
+		return fmt.Errorf("problem encoding thread %d, %v", t.ID, err)
+	}
+	info, err := s.log.Stat()
+	if err != nil {
+		return fmt.Errorf("problem reading %s, %v", s.log.Name(), err)
+	}
+
+	// A record that failed to be written or synced is cut off again, so that the next record
+	// follows neither a partial line nor a change the store went on without.
+	if _, err := s.log.Write(append(line, '\n')); err != nil {
+		s.log.Truncate(info.Size())
+		return fmt.Errorf("problem writing to %s, %v", s.log.Name(), err)
+	}
+	if err := s.log.Sync(); err != nil {
+		s.log.Truncate(info.Size())
+		return fmt.Errorf("problem syncing %s, %v", s.log.Name(), err)
+	}
+
+	s.records++
+	return nil
+}
+
+// compactIfDue must be called with mu held, after the change just logged is applied in memory.
+// A failed compaction is retried on the next change; the log still holds every record.
+func (s *WALStore) compactIfDue() {
+	if s.records < s.compactEvery {
+		return
+	}
+	if err := s.compact(); err != nil {
+		log.Printf("Unable to compact %s, %v", s.log.Name(), err)
+	}
+}
+
+// Compact writes every thread to a new snapshot and empties the log.
+func (s *WALStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+// compact must be called with mu held. A crash between writing the snapshot and emptying the
+// log only means the log is replayed over a snapshot that already holds its records.
+func (s *WALStore) compact() error {
+	if err := writeThreadsFile(s.snapshotPath, "", s.threads); err != nil {
+		return err
+	}
+	if err := s.log.Truncate(0); err != nil {
+		return fmt.Errorf("problem emptying %s, %v", s.log.Name(), err)
+	}
+	s.records = 0
+	return s.log.Sync()
+}
+
+// update must be called with mu held. It applies change to a copy of thread id, and keeps the
+// copy only once it is in the log, so a failed write leaves the store as it was.
+func (s *WALStore) update(id int, change func(Threads) error) (Thread, error) {
+	i := s.threads.indexOf(id)
+	if i < 0 {
+		return Thread{}, MissingThreadErr
+	}
+
+	working := Threads{s.threads[i].clone()}
+	if err := change(working); err != nil {
+		return Thread{}, err
+	}
+	if err := s.append(working[0]); err != nil {
+		return Thread{}, err
+	}
+	s.threads[i] = working[0]
+	s.compactIfDue()
+	return working[0].clone(), nil
+}
+
+func (s *WALStore) SaveThread(ctx context.Context, t Thread) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.ID = s.nextID
+	if err := s.append(t); err != nil {
+		return Thread{}, err
+	}
+	s.nextID++
+	s.threads = append(s.threads, t.clone())
+	s.communities.add(t, len(s.threads)-1)
+	s.compactIfDue()
+	return t, nil
+}
+
+func (s *WALStore) GetThreads(ctx context.Context) (Threads, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.threads.live(), nil
+}
+
+func (s *WALStore) QueryThreads(ctx context.Context, query ThreadQuery) (ThreadPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ThreadPage{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.threads.query(query, s.communities)
+}
+
+func (s *WALStore) GetThreadByID(ctx context.Context, id int) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.threads.byID(id)
+}
+
+func (s *WALStore) UpdateThread(ctx context.Context, t Thread) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(t.ID, func(ts Threads) error {
+		_, err := ts.edit(t)
+		return err
+	})
+}
+
+func (s *WALStore) DeleteThread(ctx context.Context, id int) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(id, func(ts Threads) error {
+		_, err := ts.remove(id)
+		return err
+	})
+}
+
+func (s *WALStore) Vote(ctx context.Context, v Vote) (Thread, error) {
+	if err := ctx.Err(); err != nil {
+		return Thread{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(v.ThreadID, func(ts Threads) error {
+		_, err := ts.vote(v)
+		return err
+	})
+}
+
+func (s *WALStore) SaveComment(ctx context.Context, c Comment) (saved Comment, err error) {
+	if err := ctx.Err(); err != nil {
+		return Comment{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.update(c.ThreadID, func(ts Threads) (err error) {
+		saved, err = ts.addComment(c)
+		return err
+	})
+	return saved, err
+}
+
+func (s *WALStore) GetComments(ctx context.Context, threadID int) (Comments, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.threads.comments(threadID)
+}
@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package server_test
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"server"
+	"syscall"
+	"testing"
+)
+
+func TestWALStoreFailedWrite(t *testing.T) {
+	path, clean := createTempDBPath(t)
+	defer clean()
+
+	store, closeStore := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+	defer closeStore()
+	store.SaveThread(context.Background(), server.Thread{Content: "Hi", User: "Anna"})
+
+	info, err := os.Stat(path + ".wal")
+	if err != nil {
+		t.Fatalf("could not stat log, %v", err)
+	}
+	// Files may not grow past a few more bytes, so the next record is only partly written.
+	withFileSizeLimit(t, uint64(info.Size())+10, func() {
+		if _, err := store.SaveThread(context.Background(), server.Thread{Content: "Lost", User: "Bob"}); err == nil {
+			t.Fatal("wanted an error saving past the file size limit")
+		}
+	})
+
+	saved, err := store.SaveThread(context.Background(), server.Thread{Content: "Bye", User: "Carl"})
+	if err != nil {
+		t.Fatalf("unexpected error saving, %v", err)
+	}
+	if saved.ID != 1 {
+		t.Errorf("got ID %d, want 1 as the failed thread was never saved", saved.ID)
+	}
+
+	// Reopen without closing, as after a crash.
+	reopened, closeReopened := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+	defer closeReopened()
+	assertThreads(t, getThreads(t, reopened), []server.Thread{
+		{ID: 0, Content: "Hi", User: "Anna"},
+		{ID: 1, Content: "Bye", User: "Carl"},
+	})
+}
+
+// withFileSizeLimit runs f with the files of the process limited to size bytes, so that writes
+// past it fail with EFBIG instead of the process being killed.
+func withFileSizeLimit(t testing.TB, size uint64, f func()) {
+	t.Helper()
+	var previous syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &previous); err != nil {
+		t.Fatalf("could not get file size limit, %v", err)
+	}
+	signal.Ignore(syscall.SIGXFSZ)
+	defer signal.Reset(syscall.SIGXFSZ)
+
+	limit := previous
+	limit.Cur = size
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatalf("could not set file size limit, %v", err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_FSIZE, &previous)
+	f()
+}
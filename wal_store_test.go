@@ -0,0 +1,257 @@
+package server_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"server"
+	"strings"
+	"testing"
+)
+
+func TestWALStore(t *testing.T) {
+	t.Run("replays threads, votes and comments after a restart", func(t *testing.T) {
+		path, clean := createTempDBPath(t)
+		defer clean()
+
+		store, closeStore := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		store.SaveThread(context.Background(), server.Thread{ID: 0, Content: "Hi", User: "Anna"})
+		store.SaveThread(context.Background(), server.Thread{ID: 1, Content: "Bye", User: "Bob"})
+		store.Vote(context.Background(), server.Vote{ThreadID: 1, User: "Anna", Value: 1})
+		store.SaveComment(context.Background(), server.Comment{ThreadID: 1, Content: "Hello", User: "Carl"})
+		want := getThreads(t, store)
+
+		// Reopen without closing, as after a crash.
+		reopened, closeReopened := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		defer closeReopened()
+		assertThreads(t, getThreads(t, reopened), want)
+		closeStore()
+	})
+
+	t.Run("replays edits and deletions after a restart", func(t *testing.T) {
+		path, clean := createTempDBPath(t)
+		defer clean()
+
+		store, closeStore := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		store.SaveThread(context.Background(), server.Thread{ID: 0, Content: "Hi", User: "Anna"})
+		store.SaveThread(context.Background(), server.Thread{ID: 1, Content: "Bye", User: "Bob"})
+		store.UpdateThread(context.Background(), server.Thread{ID: 1, Content: "Bye now"})
+		store.DeleteThread(context.Background(), 0)
+
+		reopened, closeReopened := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		defer closeReopened()
+		assertThreads(t, getThreads(t, reopened), []server.Thread{{ID: 1, Content: "Bye now", User: "Bob"}})
+		closeStore()
+	})
+
+	t.Run("keeps who voted after a restart", func(t *testing.T) {
+		path, clean := createTempDBPath(t)
+		defer clean()
+
+		store, closeStore := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		store.SaveThread(context.Background(), server.Thread{Content: "Hi", User: "Anna"})
+		store.SaveComment(context.Background(), server.Comment{ThreadID: 0, Content: "Hello", User: "Bob"})
+		store.Vote(context.Background(), server.Vote{ThreadID: 0, User: "Bob", Value: 1})
+		store.Vote(context.Background(), server.Vote{ThreadID: 0, CommentID: 1, User: "Anna", Value: -1})
+		want := getThreads(t, store)
+
+		replayed, closeReplayed := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		assertThreads(t, getThreads(t, replayed), want)
+		closeReplayed()
+		closeStore()
+
+		compacted, closeCompacted := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		defer closeCompacted()
+		assertThreads(t, getThreads(t, compacted), want)
+		if got := want[0].Comments[0].Voters; !reflect.DeepEqual(got, map[string]int{"Anna": -1}) {
+			t.Errorf("got comment voters %v, want Anna's downvote", got)
+		}
+	})
+
+	t.Run("replays a deletion the snapshot already holds", func(t *testing.T) {
+		path, clean := createTempDBPath(t)
+		defer clean()
+
+		store, closeStore := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		store.SaveThread(context.Background(), server.Thread{Content: "Hi", User: "Anna"})
+		store.SaveThread(context.Background(), server.Thread{Content: "Bye", User: "Bob"})
+		store.DeleteThread(context.Background(), 0)
+		log, err := ioutil.ReadFile(path + ".wal")
+		if err != nil {
+			t.Fatalf("could not read log, %v", err)
+		}
+		closeStore()
+
+		// As after a crash between writing the snapshot and emptying the log.
+		if err := ioutil.WriteFile(path+".wal", log, 0666); err != nil {
+			t.Fatalf("could not write log, %v", err)
+		}
+		reopened, closeReopened := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		assertThreads(t, getThreads(t, reopened), []server.Thread{{ID: 1, Content: "Bye", User: "Bob"}})
+		if _, err := reopened.GetThreadByID(context.Background(), 0); err != server.MissingThreadErr {
+			t.Errorf("got error %v getting the deleted thread, want %v", err, server.MissingThreadErr)
+		}
+		closeReopened()
+
+		snapshot, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("could not open snapshot, %v", err)
+		}
+		defer snapshot.Close()
+		threads, err := server.GetThreadsFromReader(snapshot)
+		if err != nil {
+			t.Fatalf("snapshot is not a threads array, %v", err)
+		}
+		if len(threads) != 2 {
+			t.Errorf("got %d threads in the snapshot, want the thread and the tombstone", len(threads))
+		}
+	})
+
+	t.Run("queries communities after a restart", func(t *testing.T) {
+		path, clean := createTempDBPath(t)
+		defer clean()
+
+		store, closeStore := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		store.SaveThread(context.Background(), server.Thread{Content: "Hi", User: "Anna", Community: "golang"})
+		store.SaveThread(context.Background(), server.Thread{Content: "Bye", User: "Bob", Community: "rust"})
+		store.SaveThread(context.Background(), server.Thread{Content: "Hm", User: "Carl", Community: "golang"})
+		closeStore()
+
+		reopened, closeReopened := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		defer closeReopened()
+		page, err := reopened.QueryThreads(context.Background(), server.ThreadQuery{Community: "golang"})
+		if err != nil {
+			t.Fatalf("unexpected error querying, %v", err)
+		}
+		assertThreadIDs(t, page.Threads, []int{0, 2})
+	})
+
+	t.Run("reads an existing flat-file database", func(t *testing.T) {
+		path, clean := createTempDBPath(t)
+		defer clean()
+
+		original := []server.Thread{
+			{ID: 0, Content: "Hi", User: "Anna", UpVotesCount: 1},
+			{ID: 1, Content: "Bye", User: "Bob"},
+		}
+		if err := ioutil.WriteFile(path, ThreadsToBytes(t, original), 0666); err != nil {
+			t.Fatalf("could not write database, %v", err)
+		}
+
+		store, closeStore := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		defer closeStore()
+		assertThreads(t, getThreads(t, store), original)
+
+		got, err := store.Vote(context.Background(), server.Vote{ThreadID: 1, User: "Anna", Value: -1})
+		if err != nil {
+			t.Fatalf("unexpected error voting, %v", err)
+		}
+		assertThreadExceptID(t, got, server.Thread{Content: "Bye", User: "Bob", DownVotesCount: 1, Voters: map[string]int{"Anna": -1}})
+	})
+
+	t.Run("compacts the log into a snapshot", func(t *testing.T) {
+		path, clean := createTempDBPath(t)
+		defer clean()
+
+		store, closeStore := openWALStore(t, path, 3)
+		store.SaveThread(context.Background(), server.Thread{ID: 0, Content: "Hi", User: "Anna"})
+		store.SaveThread(context.Background(), server.Thread{ID: 1, Content: "Bye", User: "Bob"})
+		store.Vote(context.Background(), server.Vote{ThreadID: 0, User: "Bob", Value: 1})
+		store.Vote(context.Background(), server.Vote{ThreadID: 0, User: "Carl", Value: 1})
+		want := getThreads(t, store)
+
+		assertLogLines(t, path, 1)
+		snapshot, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("could not open snapshot, %v", err)
+		}
+		defer snapshot.Close()
+		if _, err := server.GetThreadsFromReader(snapshot); err != nil {
+			t.Errorf("snapshot is not a threads array, %v", err)
+		}
+
+		closeStore()
+		assertLogLines(t, path, 0)
+
+		ffs, closeFFS, err := server.NewFFSFromPath(path)
+		if err != nil {
+			t.Fatalf("flat-file store could not read the snapshot, %v", err)
+		}
+		defer closeFFS()
+		assertThreads(t, getThreads(t, ffs), want)
+	})
+
+	t.Run("drops a record cut short by a crash", func(t *testing.T) {
+		path, clean := createTempDBPath(t)
+		defer clean()
+
+		store, closeStore := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		store.SaveThread(context.Background(), server.Thread{ID: 0, Content: "Hi", User: "Anna"})
+		want := getThreads(t, store)
+		closeStore()
+
+		log, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			t.Fatalf("could not open log, %v", err)
+		}
+		log.WriteString(`{"op":"put","thread":{"ID":1,"Con`)
+		log.Close()
+
+		reopened, closeReopened := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		assertThreads(t, getThreads(t, reopened), want)
+
+		reopened.SaveThread(context.Background(), server.Thread{ID: 1, Content: "Bye", User: "Bob"})
+		want = getThreads(t, reopened)
+		closeReopened()
+
+		again, closeAgain := openWALStore(t, path, server.DefaultWALCompactionThreshold)
+		defer closeAgain()
+		assertThreads(t, getThreads(t, again), want)
+	})
+
+	t.Run("refuses a corrupt record", func(t *testing.T) {
+		path, clean := createTempDBPath(t)
+		defer clean()
+
+		ioutil.WriteFile(path+".wal", []byte("not json\n"), 0666)
+
+		_, _, err := server.NewWALStoreFromPath(path, server.DefaultWALCompactionThreshold)
+		if err == nil {
+			t.Error("wanted an error opening a corrupt log")
+		}
+	})
+}
+
+func createTempDBPath(t testing.TB) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatalf("could not create temp dir %v", err)
+	}
+	return filepath.Join(dir, "threads.db.json"), func() { os.RemoveAll(dir) }
+}
+
+func openWALStore(t testing.TB, path string, compactEvery int) (*server.WALStore, func()) {
+	t.Helper()
+	store, closeStore, err := server.NewWALStoreFromPath(path, compactEvery)
+	if err != nil {
+		t.Fatalf("Unable to make new WAL store, %v", err)
+	}
+	return store, closeStore
+}
+
+func assertLogLines(t testing.TB, path string, want int) {
+	t.Helper()
+	log, err := ioutil.ReadFile(path + ".wal")
+	if err != nil {
+		t.Fatalf("could not read log, %v", err)
+	}
+	if got := strings.Count(string(log), "\n"); got != want {
+		t.Errorf("got %d records in the log, want %d", got, want)
+	}
+	if (len(log) > 0) != (want > 0) {
+		t.Errorf("log holds %q", log)
+	}
+}
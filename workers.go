@@ -1,26 +1,213 @@
 package server
 
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
 func (s *Server) StartWorkers() {
-	go s.ThreadSaver()
-	go s.SocketUpdater()
+	s.savers.Add(1)
+	go func() {
+		defer s.savers.Done()
+		s.ThreadSaver()
+	}()
+
+	s.updaters.Add(1)
+	go func() {
+		defer s.updaters.Done()
+		s.SocketUpdater()
+	}()
+
+	go s.WeightRefresher()
+	go s.PairEvictor()
 }
 
+// threadRequest is a thread sent by a chat client, waiting to be saved.
+type threadRequest struct {
+	thread Thread
+	client *ClientWS
+	id     string // The message to ack once the thread is saved.
+}
+
+// ThreadSaver saves queued threads until threadChannel is closed by Shutdown.
 func (s *Server) ThreadSaver() {
-	for {
-		t := <-s.threadChannel
-		s.store.SaveThread(t)
-		s.sendChannel <- "thread"
+	for req := range s.threadChannel {
+		t, err := s.saveThread(context.Background(), req.thread)
+		if err != nil {
+			s.reply(req.client, ErrorMessage, req.id, NewMessageError(err))
+		} else if req.id != "" {
+			s.reply(req.client, AckMessage, req.id, t)
+		}
 	}
 }
 
+// SocketUpdater sends events and replies to clients until eventChannel is closed by Shutdown.
 func (s *Server) SocketUpdater() {
+	sendChannel := s.sendChannel
+	for {
+		select {
+		case d, ok := <-sendChannel:
+			if !ok {
+				sendChannel = nil
+				continue
+			}
+			s.socketManager.Broadcast(d.clients, d.frame)
+		case d, ok := <-s.eventChannel:
+			if !ok {
+				return
+			}
+			clients := []*ClientWS{d.client}
+			if d.client == nil {
+				clients = s.subscribers(d.topics)
+			}
+			for _, frame := range d.frames {
+				s.socketManager.Broadcast(clients, frame)
+			}
+		}
+	}
+}
+
+// subscribers returns the clients subscribed to any of topics, or every chat client when there
+// are none. Chat clients join the topic of a single feed, so no client is listed twice.
+func (s *Server) subscribers(topics []string) []*ClientWS {
+	if len(topics) == 0 {
+		return s.socketManager.GetChatClients()
+	}
+	var clients []*ClientWS
+	for _, topic := range topics {
+		clients = append(clients, s.socketManager.GetSubscribers(topic)...)
+	}
+	return clients
+}
+
+// WeightRefresher periodically refreshes bubble weights so that bubbles shrink with age.
+func (s *Server) WeightRefresher() {
+	ticker := time.NewTicker(s.weightRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.RefreshWeights(now)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// PairEvictor periodically evicts the /pair documents nobody has edited for PairIdleTimeout, or
+// DefaultPairIdleTimeout when it is not positive.
+func (s *Server) PairEvictor() {
+	timeout := s.PairIdleTimeout
+	if timeout <= 0 {
+		timeout = DefaultPairIdleTimeout
+	}
+	interval := timeout / 2
+	if interval <= 0 {
+		interval = timeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
-		signal := <-s.sendChannel
-		switch signal {
-		case "thread":
-			s.socketManager.Broadcast(s.socketManager.GetChatClients(), s.store.GetThreads())
-		case "pair":
-			s.socketManager.Broadcast(s.socketManager.GetPairClients(), s.text)
+		select {
+		case now := <-ticker.C:
+			s.pairs.evictIdle(now, timeout)
+		case <-s.quit:
+			return
 		}
 	}
 }
+
+// queueThread hands req to the threadSaver, unless the server is shutting down.
+func (s *Server) queueThread(req threadRequest) error {
+	s.closingMu.RLock()
+	defer s.closingMu.RUnlock()
+
+	if s.closing {
+		return ServerClosedErr
+	}
+	s.threadChannel <- req
+	return nil
+}
+
+// queuePairDelivery hands d to the socketUpdater, unless the server is shutting down.
+func (s *Server) queuePairDelivery(d pairDelivery) error {
+	return s.whileOpen(func() error {
+		s.sendChannel <- d
+		return nil
+	})
+}
+
+// whileOpen runs f, unless the server is shutting down, and keeps it from shutting down until f
+// returns, so that f can still queue to sendChannel.
+func (s *Server) whileOpen(f func() error) error {
+	s.closingMu.RLock()
+	defer s.closingMu.RUnlock()
+
+	if s.closing {
+		return ServerClosedErr
+	}
+	return f()
+}
+
+// Shutdown stops taking new threads, waits for the workers to save and send everything already
+// queued, and then closes every websocket client with "going away" once its queue is written.
+// It returns ctx's error if ctx is done first. Shutdown does not close the store; stop the HTTP
+// server first so that no request is still using it.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closingMu.Lock()
+	if s.closing {
+		s.closingMu.Unlock()
+		return ServerClosedErr
+	}
+	s.closing = true
+	close(s.threadChannel)
+	close(s.sendChannel)
+	s.closingMu.Unlock()
+	close(s.quit)
+
+	if err := waitFor(ctx, &s.savers); err != nil {
+		return err
+	}
+
+	s.eventsMu.Lock()
+	s.eventsClosed = true
+	close(s.eventChannel)
+	s.eventsMu.Unlock()
+
+	if err := waitFor(ctx, &s.updaters); err != nil {
+		return err
+	}
+
+	clients := append(s.socketManager.GetChatClients(), s.socketManager.GetPairClients()...)
+	for _, client := range clients {
+		client.CloseAfterFlush(websocket.CloseGoingAway, shutdownReason)
+	}
+	for _, client := range clients {
+		select {
+		case <-client.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func waitFor(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}